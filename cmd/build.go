@@ -9,8 +9,8 @@ import (
 )
 
 var (
-	// 	filePath string
-	alias string
+	alias     string
+	buildOpts build.Options
 )
 
 func init() {
@@ -18,17 +18,26 @@ func init() {
 	rootCmd.AddCommand(buildCmd)
 
 	// Define flags for the build command
-	// buildCmd.Flags().StringVarP(&filePath, "file", "f", "", "Path to the Dockerfile")
+	buildCmd.Flags().StringVarP(&buildOpts.File, "file", "f", "", "Path to the build file (default <context>/"+build.DefaultFile+")")
+	buildCmd.Flags().StringArrayVarP(&buildOpts.Tags, "tag", "t", nil, "Name and optionally a tag for the image (name:tag), can be repeated")
+	buildCmd.Flags().StringArrayVar(&buildOpts.Secrets, "secret", nil, "Secret for RUN --mount=type=secret (id=<id>,src=<file>), can be repeated")
+	buildCmd.Flags().StringVar(&buildOpts.RunOptions.Network, "network", "", "Default network of RUN steps (none or host)")
 	buildCmd.Flags().StringVarP(&alias, "alias", "a", "", "Alias for the image")
+	buildCmd.Flags().MarkDeprecated("alias", "use --tag instead")
+	addDNSFlags(buildCmd, &buildOpts.RunOptions)
 }
 
 // buildCmd creates the build command
 var buildCmd = &cobra.Command{
-	Use:   "build [file]",
+	Use:   "build [-f file] <context>",
 	Short: "Build a container",
+	Long:  "Build an image from a build file. The context is a directory, a tar archive (optionally compressed) or - to read an archive from standard input; local paths in instructions are relative to it. For archive contexts, -f names a file in the archive.",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := build.Build(args[0], alias); err != nil {
+		if alias != "" {
+			buildOpts.Tags = append(buildOpts.Tags, alias)
+		}
+		if err := build.Build(args[0], buildOpts); err != nil {
 			// It's appropriate to log and exit here as we're at the app boundary
 			config.Log.Errorf("Build failed: %v", err)
 			os.Exit(1)
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lariskovski/containy/internal/build"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/download"
+	"github.com/lariskovski/containy/internal/term"
+	"github.com/spf13/cobra"
+)
+
+var pruneDownloads bool
+
+func init() {
+	// Add the builder command and its subcommands to the root command
+	rootCmd.AddCommand(builderCmd)
+	builderCmd.AddCommand(builderPruneCmd)
+
+	builderPruneCmd.Flags().BoolVar(&pruneDownloads, "downloads", false, "Also remove the download cache of ADD and FROM URLs")
+}
+
+// builderCmd groups the commands managing the build caches
+var builderCmd = &cobra.Command{
+	Use:   "builder",
+	Short: "Manage the build caches",
+}
+
+// builderPruneCmd removes the build caches
+var builderPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the RUN cache mounts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		freed, err := build.Prune()
+		if err != nil {
+			config.Log.Errorf("Failed to prune build caches: %v", err)
+			os.Exit(1)
+		}
+		if pruneDownloads {
+			size, err := download.Prune()
+			if err != nil {
+				config.Log.Errorf("Failed to prune download cache: %v", err)
+				os.Exit(1)
+			}
+			freed += size
+		}
+		fmt.Printf("Total reclaimed space: %s\n", term.HumanSize(freed))
+	},
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/term"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	// Add the history command to the root command
+	rootCmd.AddCommand(historyCmd)
+}
+
+// historyCmd shows the instructions an image was built from
+var historyCmd = &cobra.Command{
+	Use:   "history [image]",
+	Short: "Show the history of an image",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		img, err := image.Resolve(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to show history: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "LAYER\tCREATED\tCREATED BY\tSIZE")
+		// Newest instruction first
+		for i := len(img.History) - 1; i >= 0; i-- {
+			h := img.History[i]
+			layer := h.LayerID
+			if h.EmptyLayer {
+				layer = "<missing>"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", layer, humanDuration(h.Created), h.CreatedBy, term.HumanSize(h.Size))
+		}
+		w.Flush()
+	},
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/term"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	// Add the images command to the root command
+	rootCmd.AddCommand(imagesCmd)
+}
+
+// imagesCmd lists the images in the local store
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "List images",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := image.List()
+		if err != nil {
+			config.Log.Fatalf("Failed to list images: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+		for _, img := range images {
+			names, err := image.Names(img.ID)
+			if err != nil {
+				config.Log.Fatalf("Failed to list images: %v", err)
+			}
+			if len(names) == 0 {
+				fmt.Fprintf(w, "<none>\t<none>\t%s\t%s\t%s\n",
+					img.ShortID(), humanDuration(img.Created), term.HumanSize(img.Size))
+			}
+			for _, name := range names {
+				repository, tag := splitName(name)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					repository, tag, img.ShortID(), humanDuration(img.Created), term.HumanSize(img.Size))
+			}
+		}
+		w.Flush()
+	},
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/spf13/cobra"
+)
+
+var importTag string
+
+func init() {
+	// Add the import command to the root command
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&importTag, "tag", "t", "", "Name for the imported image (name:tag), if the archive holds a single image")
+}
+
+// importCmd imports images from docker save archives and OCI image layouts
+var importCmd = &cobra.Command{
+	Use:   "import [archive|directory]",
+	Short: "Import images from a docker save archive or an OCI image layout",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if importTag != "" {
+			if _, err := image.ParseReference(importTag); err != nil {
+				config.Log.Fatalf("Invalid tag: %v", err)
+			}
+		}
+
+		imported, err := oci.Import(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to import %s: %v", args[0], err)
+		}
+		if importTag != "" && len(imported) != 1 {
+			config.Log.Fatalf("Cannot tag %d images as %s", len(imported), importTag)
+		}
+
+		for _, i := range imported {
+			names := []string{}
+			if i.Name != "" {
+				names = append(names, i.Name)
+			}
+			if importTag != "" {
+				names = append(names, importTag)
+			}
+			for _, name := range names {
+				if err := image.Tag(name, i.Image.ID); err != nil {
+					config.Log.Fatalf("Failed to tag image %s: %v", i.Image.ShortID(), err)
+				}
+			}
+			printLoaded(i.Image)
+		}
+	},
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/spf13/cobra"
+)
+
+var loadInput string
+
+func init() {
+	// Add the load command to the root command
+	rootCmd.AddCommand(loadCmd)
+
+	loadCmd.Flags().StringVarP(&loadInput, "input", "i", "", "Read from a tar archive file, optionally compressed, instead of standard input")
+}
+
+// loadCmd imports images from an OCI image layout or docker save tar archive
+var loadCmd = &cobra.Command{
+	Use:   "load",
+	Short: "Load images from an OCI image layout or docker save tar archive",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var in io.Reader = os.Stdin
+		if loadInput != "" {
+			f, err := os.Open(loadInput)
+			if err != nil {
+				config.Log.Fatalf("Failed to open %s: %v", loadInput, err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		imported, err := oci.Load(in)
+		for _, i := range imported {
+			printLoaded(i.Image)
+		}
+		if err != nil {
+			config.Log.Fatalf("Failed to load images: %v", err)
+		}
+	},
+}
+
+// printLoaded prints the names of an imported image, or its ID if it has none.
+func printLoaded(img *image.Image) {
+	names, err := image.Names(img.ID)
+	if err != nil || len(names) == 0 {
+		fmt.Printf("Loaded image ID: %s\n", img.ID)
+		return
+	}
+	for _, name := range names {
+		fmt.Printf("Loaded image: %s\n", name)
+	}
+}
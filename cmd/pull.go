@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/lariskovski/containy/internal/registry"
+	"github.com/spf13/cobra"
+)
+
+var pullPlatform string
+
+func init() {
+	// Add the pull command to the root command
+	rootCmd.AddCommand(pullCmd)
+
+	pullCmd.Flags().StringVar(&pullPlatform, "platform", oci.DefaultPlatform().String(), "Platform to pull for multi-platform images, e.g. linux/arm64")
+}
+
+// pullCmd downloads an image from a registry
+var pullCmd = &cobra.Command{
+	Use:   "pull [registry/repository:tag]",
+	Short: "Pull an image from a registry",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ref, err := image.ParseReference(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to pull image: %v", err)
+		}
+		platform, err := oci.ParsePlatform(pullPlatform)
+		if err != nil {
+			config.Log.Fatalf("Failed to pull image: %v", err)
+		}
+
+		img, err := registry.Pull(ref, platform)
+		if err != nil {
+			config.Log.Fatalf("Failed to pull image: %v", err)
+		}
+		fmt.Println(img.ID)
+	},
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/registry"
+	"github.com/spf13/cobra"
+)
+
+var pushChunkSize int64
+
+func init() {
+	// Add the push command to the root command
+	rootCmd.AddCommand(pushCmd)
+
+	pushCmd.Flags().Int64Var(&pushChunkSize, "chunk-size", registry.DefaultChunkSize, "Upload blobs larger than this many bytes in chunks, 0 to upload them whole")
+}
+
+// pushCmd uploads a local image to a registry
+var pushCmd = &cobra.Command{
+	Use:   "push [registry/repository:tag]",
+	Short: "Push an image to a registry",
+	Long:  "Push the local image with the given name to the registry and repository it names. Use tag to give an image a registry name first.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ref, err := image.ParseReference(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to push image: %v", err)
+		}
+		img, err := image.Resolve(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to push image: %v", err)
+		}
+
+		digest, err := registry.Push(ref, img, pushChunkSize)
+		if err != nil {
+			config.Log.Fatalf("Failed to push image: %v", err)
+		}
+		fmt.Printf("%s@%s\n", ref.Name(), digest)
+	},
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/container"
+	"github.com/spf13/cobra"
+)
+
+var removeVolumes bool
+
+func init() {
+	// Add the rm command to the root command
+	rootCmd.AddCommand(rmCmd)
+
+	rmCmd.Flags().BoolVarP(&removeVolumes, "volumes", "v", false, "Remove anonymous volumes associated with the container")
+}
+
+// rmCmd removes container records
+var rmCmd = &cobra.Command{
+	Use:   "rm [container...]",
+	Short: "Remove one or more containers",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, id := range args {
+			if err := container.Remove(id, removeVolumes); err != nil {
+				config.Log.Errorf("Failed to remove container %s: %v", id, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/container"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/spf13/cobra"
+)
+
+var forceRemoveImage bool
+
+func init() {
+	// Add the rmi command to the root command
+	rootCmd.AddCommand(rmiCmd)
+
+	rmiCmd.Flags().BoolVarP(&forceRemoveImage, "force", "f", false, "Remove the image even if stopped containers use it or it has several names")
+}
+
+// rmiCmd removes images and the layers no other image uses
+var rmiCmd = &cobra.Command{
+	Use:   "rmi [image...]",
+	Short: "Remove one or more images",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, ref := range args {
+			if err := removeImage(ref, forceRemoveImage); err != nil {
+				config.Log.Errorf("Failed to remove image %s: %v", ref, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// removeImage untags or deletes an image, refusing to delete images that
+// containers were created from.
+func removeImage(ref string, force bool) error {
+	img, err := image.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	names, err := image.Names(img.ID)
+	if err != nil {
+		return err
+	}
+	isName, err := image.IsName(ref)
+	if err != nil {
+		return err
+	}
+
+	// Removing one of several names leaves the image in place
+	if len(names) <= 1 || !isName {
+		if err := container.CheckImageUnused(img.ID, force); err != nil {
+			return err
+		}
+	}
+
+	removed, err := image.Remove(ref, force)
+	for _, r := range removed {
+		if strings.HasPrefix(r, "sha256:") {
+			fmt.Printf("Deleted: %s\n", r)
+		} else {
+			fmt.Printf("Untagged: %s\n", r)
+		}
+	}
+	return err
+}
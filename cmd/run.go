@@ -8,21 +8,50 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var runOpts container.Options
+
 // init initializes the run command and adds it to the root command
 func init() {
 	// Add the run command to the root command
 	rootCmd.AddCommand(runCmd)
+
+	// Stop flag parsing at the image so the container command keeps its own flags
+	runCmd.Flags().SetInterspersed(false)
+	runCmd.Flags().StringArrayVarP(&runOpts.Volumes, "volume", "v", nil, "Bind mount a volume (source:target[:ro|rw])")
+	runCmd.Flags().StringArrayVar(&runOpts.Tmpfs, "tmpfs", nil, "Mount a tmpfs filesystem (target[:options])")
+	runCmd.Flags().BoolVar(&runOpts.ReadOnly, "read-only", false, "Mount the container's root filesystem as read-only")
+	runCmd.Flags().BoolVar(&runOpts.Remove, "rm", false, "Remove the container and its anonymous volumes when it exits")
+	runCmd.Flags().BoolVarP(&runOpts.Interactive, "interactive", "i", false, "Keep stdin attached to the container")
+	runCmd.Flags().BoolVarP(&runOpts.TTY, "tty", "t", false, "Allocate a pseudo-terminal for the container")
+	runCmd.Flags().StringVar(&runOpts.IPC, "ipc", "", "IPC namespace to use (host or container:<id>)")
+	runCmd.Flags().StringVar(&runOpts.PID, "pid", "", "PID namespace to use (host or container:<id>)")
+	runCmd.Flags().StringVar(&runOpts.UTS, "uts", "", "UTS namespace to use (host or container:<id>)")
+	runCmd.Flags().StringVar(&runOpts.Hostname, "hostname", "", "Container host name")
+	runCmd.Flags().StringVar(&runOpts.Domainname, "domainname", "", "Container NIS domain name")
+	addDNSFlags(runCmd, &runOpts)
+	runCmd.Flags().StringArrayVarP(&runOpts.Env, "env", "e", nil, "Set environment variables (KEY=VALUE)")
+	runCmd.Flags().StringArrayVar(&runOpts.EnvFiles, "env-file", nil, "Read environment variables from a file")
+	runCmd.Flags().StringVarP(&runOpts.WorkingDir, "workdir", "w", "", "Working directory inside the container")
+	runCmd.Flags().StringVarP(&runOpts.User, "user", "u", "", "Username or UID (format: user[:group])")
 }
 
 // NewRunCmd creates the run command
 var runCmd = &cobra.Command{
-	Use:   "run [overlay-dir] [command]",
+	Use:   "run [image] [command]",
 	Short: "Run a container",
-	Args:  cobra.MinimumNArgs(2),
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := container.Create(args); err != nil {
+		if err := container.Run(args, runOpts); err != nil {
 			config.Log.Errorf("Container execution failed: %v", err)
 			os.Exit(1)
 		}
 	},
 }
+
+// addDNSFlags registers the flags configuring a container's /etc/hosts and
+// /etc/resolv.conf, shared by the run and build commands.
+func addDNSFlags(cmd *cobra.Command, opts *container.Options) {
+	cmd.Flags().StringArrayVar(&opts.DNS, "dns", nil, "Set custom DNS servers")
+	cmd.Flags().StringArrayVar(&opts.DNSSearch, "dns-search", nil, "Set custom DNS search domains")
+	cmd.Flags().StringArrayVar(&opts.ExtraHosts, "add-host", nil, "Add a custom host-to-IP mapping (host:ip)")
+}
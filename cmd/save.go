@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/lariskovski/containy/internal/term"
+	"github.com/spf13/cobra"
+)
+
+var saveOutput string
+
+func init() {
+	// Add the save command to the root command
+	rootCmd.AddCommand(saveCmd)
+
+	saveCmd.Flags().StringVarP(&saveOutput, "output", "o", "", "Write to a file instead of standard output")
+}
+
+// saveCmd exports images as an OCI image layout tar archive
+var saveCmd = &cobra.Command{
+	Use:   "save [image...]",
+	Short: "Save one or more images to an OCI image layout tar archive",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		out := os.Stdout
+		if saveOutput != "" {
+			f, err := os.Create(saveOutput)
+			if err != nil {
+				config.Log.Fatalf("Failed to create %s: %v", saveOutput, err)
+			}
+			out = f
+		} else if term.IsTerminal(os.Stdout) {
+			config.Log.Fatalf("Refusing to write the archive to a terminal, use -o or redirect the output")
+		}
+
+		if err := oci.Save(out, args); err != nil {
+			if saveOutput != "" {
+				os.Remove(saveOutput)
+			}
+			config.Log.Fatalf("Failed to save images: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			config.Log.Fatalf("Failed to write archive: %v", err)
+		}
+	},
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	// Add the tag command to the root command
+	rootCmd.AddCommand(tagCmd)
+}
+
+// tagCmd gives an existing image an additional name
+var tagCmd = &cobra.Command{
+	Use:   "tag [source] [target]",
+	Short: "Create a name that refers to an image",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		img, err := image.Resolve(args[0])
+		if err != nil {
+			config.Log.Fatalf("Failed to tag image: %v", err)
+		}
+		if err := image.Tag(args[1], img.ID); err != nil {
+			config.Log.Fatalf("Failed to tag image: %v", err)
+		}
+	},
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lariskovski/containy/internal/image"
+)
+
+// splitName splits an image name into repository and tag for display.
+// Digest references have no tag.
+func splitName(name string) (string, string) {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return name, "<none>"
+	}
+	if ref.Tag == "" {
+		return ref.Name(), "<none>"
+	}
+	return ref.Name(), ref.Tag
+}
+
+// humanDuration formats the time elapsed since t, e.g. "3 hours ago".
+func humanDuration(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "Less than a minute ago"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute") + " ago"
+	case d < 24*time.Hour:
+		return plural(int(d.Hours()), "hour") + " ago"
+	case d < 30*24*time.Hour:
+		return plural(int(d.Hours()/24), "day") + " ago"
+	case d < 365*24*time.Hour:
+		return plural(int(d.Hours()/24/30), "month") + " ago"
+	default:
+		return plural(int(d.Hours()/24/365), "year") + " ago"
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
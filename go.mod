@@ -3,8 +3,10 @@ module github.com/lariskovski/containy
 go 1.23.4
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v1.9.1
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/sys v0.32.0
 )
 
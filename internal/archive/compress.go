@@ -0,0 +1,65 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// magics are the first bytes of the streams of each supported compression format.
+var magics = map[string][]byte{
+	"gzip":  {0x1f, 0x8b},
+	"bzip2": []byte("BZh"),
+	"xz":    {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	"zstd":  {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// detectCompression returns the compression format of a stream given its
+// first bytes, or "" if it is not compressed.
+func detectCompression(header []byte) string {
+	for format, magic := range magics {
+		if bytes.HasPrefix(header, magic) {
+			return format
+		}
+	}
+	return ""
+}
+
+// Decompress returns a reader for the content of r, decompressing it on
+// the fly if it is gzip, bzip2, xz or zstd compressed. The format is
+// detected from the stream's magic bytes. Closing the returned reader
+// releases the decompressor; it does not close r.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch detectCompression(header) {
+	case "gzip":
+		return gzip.NewReader(br)
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case "xz":
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xz stream: %w", err)
+		}
+		return io.NopCloser(xr), nil
+	case "zstd":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,437 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/fsutil"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// WhiteoutPrefix marks a file deleted by a layer in OCI and Docker layer archives
+	WhiteoutPrefix = ".wh."
+
+	// WhiteoutOpaque marks a directory whose lower content is hidden by a layer
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+
+	// overlayXattrPrefix prefixes the extended attributes overlayfs uses internally
+	overlayXattrPrefix = "trusted.overlay."
+
+	// overlayOpaqueXattr marks an opaque directory in an overlayfs upper directory
+	overlayOpaqueXattr = overlayXattrPrefix + "opaque"
+
+	// paxXattrPrefix prefixes extended attributes stored in PAX records
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// WriteLayer writes the content of a layer directory as a tar archive.
+// Overlayfs whiteouts (0/0 character devices) become ".wh.<name>" files and
+// opaque directories get a ".wh..wh..opq" entry, as in OCI layer archives.
+//
+// Parameters:
+//   - w: The writer receiving the uncompressed tar stream
+//   - dir: The layer's diff directory
+//
+// Returns:
+//   - error: Any error encountered while reading the layer or writing the archive
+func WriteLayer(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	// Hard links are recorded by inode so that each file is stored once
+	links := map[uint64]string{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		if info.Mode()&os.ModeSocket != 0 {
+			// Sockets only exist while their server runs
+			return nil
+		}
+		if isWhiteout(info) {
+			return writeMarker(tw, filepath.ToSlash(filepath.Join(filepath.Dir(rel), WhiteoutPrefix+info.Name())), info)
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to create header for %s: %w", path, err)
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := links[stat.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[stat.Ino] = name
+			}
+		}
+
+		// Extended attributes such as file capabilities travel as PAX records
+		xattrs, err := listXattrs(path)
+		if err != nil {
+			return fmt.Errorf("failed to read extended attributes of %s: %w", path, err)
+		}
+		for attr, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxXattrPrefix+attr] = value
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write header for %s: %w", path, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyFileTo(tw, path); err != nil {
+				return fmt.Errorf("failed to archive %s: %w", path, err)
+			}
+		}
+
+		if info.IsDir() {
+			if opaque, err := getXattr(path, overlayOpaqueXattr); err == nil && string(opaque) == "y" {
+				return writeMarker(tw, name+"/"+WhiteoutOpaque, info)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ApplyLayer extracts a layer archive into a layer directory.
+// ".wh.<name>" entries become overlayfs whiteouts and ".wh..wh..opq"
+// entries mark their directory opaque, so the directory can be used as
+// an overlayfs layer on top of the layers below it.
+//
+// Entries must stay within dir: absolute names, names containing ".."
+// that leave dir, and symbolic links resolving outside of dir are
+// rejected or confined to dir.
+//
+// Parameters:
+//   - r: The uncompressed tar stream
+//   - dir: The directory to extract into
+//
+// Returns:
+//   - error: Any error encountered while extracting the archive
+func ApplyLayer(r io.Reader, dir string) error {
+	return extract(r, dir, true)
+}
+
+// Extract extracts a tar archive into dir, with the same confinement to
+// dir as ApplyLayer but without interpreting whiteout files.
+func Extract(r io.Reader, dir string) error {
+	return extract(r, dir, false)
+}
+
+func extract(r io.Reader, dir string, whiteouts bool) error {
+	// The mode and timestamps of directories are applied once the archive
+	// is extracted: creating their children would update the timestamps,
+	// and a read-only mode could prevent it
+	var dirs []deferredDir
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		target, err := applyEntry(tr, hdr, dir, whiteouts)
+		if err != nil {
+			return err
+		}
+		if target != "" && hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, deferredDir{path: target, hdr: hdr})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setModeAndTimes(dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferredDir is an extracted directory whose metadata is applied last.
+type deferredDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// applyEntry extracts a single archive entry into dir. It returns the
+// path of the extracted file, or "" if the entry left nothing to finish
+// (whiteouts, hard links and metadata entries).
+func applyEntry(tr *tar.Reader, hdr *tar.Header, dir string, whiteouts bool) (string, error) {
+	name, err := cleanName(hdr.Name)
+	if err != nil {
+		return "", err
+	}
+	if name == "." {
+		return "", nil
+	}
+
+	parent, err := SecureJoin(dir, filepath.Dir(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", hdr.Name, err)
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %w", hdr.Name, err)
+	}
+
+	base := filepath.Base(name)
+	switch {
+	case !whiteouts:
+	case base == WhiteoutOpaque:
+		if err := unix.Lsetxattr(parent, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return "", fmt.Errorf("failed to mark %s opaque: %w", filepath.Dir(name), err)
+		}
+		return "", nil
+	case strings.HasPrefix(base, WhiteoutPrefix):
+		// The whiteout must name an entry of its parent, resolved by
+		// SecureJoin: ".wh.." and ".wh..." would otherwise replace the parent
+		// itself or the directory above it. The entry is not resolved, so
+		// that a symlink is replaced rather than its target
+		removed := strings.TrimPrefix(base, WhiteoutPrefix)
+		if removed == "" || removed == "." || removed == ".." || strings.ContainsRune(removed, filepath.Separator) {
+			return "", fmt.Errorf("invalid whiteout entry %q", hdr.Name)
+		}
+		target := filepath.Join(parent, removed)
+		if err := os.RemoveAll(target); err != nil {
+			return "", err
+		}
+		if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+			return "", fmt.Errorf("failed to create whiteout for %s: %w", hdr.Name, err)
+		}
+		return "", nil
+	}
+
+	target := filepath.Join(parent, base)
+	// Entries replace what is already there, except directories, which are merged
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return "", err
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, mode); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create directory %s: %w", hdr.Name, err)
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+		if err != nil {
+			return "", fmt.Errorf("failed to create file %s: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to write file %s: %w", hdr.Name, err)
+		}
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("failed to write file %s: %w", hdr.Name, err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return "", fmt.Errorf("failed to create symlink %s -> %s: %w", hdr.Name, hdr.Linkname, err)
+		}
+	case tar.TypeLink:
+		linkName, err := cleanName(hdr.Linkname)
+		if err != nil {
+			return "", fmt.Errorf("invalid hard link %s: %w", hdr.Name, err)
+		}
+		// The link source itself may be a symlink, so only its parent is resolved
+		sourceDir, err := SecureJoin(dir, filepath.Dir(linkName))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve hard link %s: %w", hdr.Name, err)
+		}
+		source := filepath.Join(sourceDir, filepath.Base(linkName))
+		// The link shares the metadata of its source, extracted before it
+		if err := os.Link(source, target); err != nil {
+			return "", fmt.Errorf("failed to create hard link %s -> %s: %w", hdr.Name, hdr.Linkname, err)
+		}
+		return "", nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devMode = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devMode = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(target, devMode|uint32(mode), dev); err != nil {
+			return "", fmt.Errorf("failed to create device %s: %w", hdr.Name, err)
+		}
+	default:
+		// PAX global headers and other metadata entries carry no file
+		return "", nil
+	}
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return "", fmt.Errorf("failed to set owner of %s: %w", hdr.Name, err)
+	}
+	// Extended attributes are set after the owner, as changing the owner
+	// clears file capabilities
+	if err := setXattrs(target, hdr); err != nil {
+		return "", err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err := setModeAndTimes(target, hdr); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+// setXattrs sets the extended attributes recorded in an entry's PAX
+// records. Attributes the filesystem does not support are skipped.
+func setXattrs(path string, hdr *tar.Header) error {
+	for key, value := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok || strings.HasPrefix(attr, overlayXattrPrefix) {
+			continue
+		}
+		err := unix.Lsetxattr(path, attr, []byte(value), 0)
+		if err == unix.ENOTSUP {
+			config.Log.Debugf("Skipping unsupported extended attribute %s of %s", attr, hdr.Name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set %s on %s: %w", attr, hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// setModeAndTimes applies the mode, including setuid, setgid and sticky
+// bits, and the access and modification times of an entry.
+func setModeAndTimes(path string, hdr *tar.Header) error {
+	if hdr.Typeflag != tar.TypeSymlink {
+		// Apply the full mode last: the umask and chown both strip bits
+		if err := os.Chmod(path, fsutil.FileMode(hdr.FileInfo().Mode())); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", hdr.Name, err)
+		}
+	}
+
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to set times of %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// isWhiteout reports whether info describes an overlayfs whiteout.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// writeMarker writes an empty whiteout marker file.
+func writeMarker(tw *tar.Writer, name string, info os.FileInfo) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+	}
+	return tw.WriteHeader(hdr)
+}
+
+// getXattr reads an extended attribute without following symbolic links.
+// It returns nil if the attribute is not set.
+func getXattr(path, attr string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(path, attr, buf)
+		if err == unix.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// listXattrs returns the extended attributes of a file without following
+// symbolic links, except those overlayfs uses internally.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, overlayXattrPrefix) {
+			continue
+		}
+		value, err := getXattr(path, attr)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			xattrs[attr] = string(value)
+		}
+	}
+	return xattrs, nil
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// layerTar builds an uncompressed tar stream from the given headers; regular
+// files get their name as content.
+func layerTar(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			content = []byte(hdr.Name)
+			hdr.Size = int64(len(content))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestApplyLayerRejectsHostileWhiteouts(t *testing.T) {
+	for _, name := range []string{".wh..", ".wh...", "sub/.wh..", "sub/.wh...", ".wh."} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			sibling := filepath.Join(parent, "sibling")
+			if err := os.WriteFile(sibling, []byte("keep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(parent, "layer")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			layer := layerTar(t,
+				&tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755},
+				&tar.Header{Name: "sub/file", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644},
+			)
+			if err := ApplyLayer(layer, dir); err == nil {
+				t.Fatalf("ApplyLayer accepted whiteout %q", name)
+			}
+
+			if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+				t.Fatalf("extraction root was replaced: %v", err)
+			}
+			if info, err := os.Lstat(filepath.Join(dir, "sub")); err != nil || !info.IsDir() {
+				t.Fatalf("sub was replaced: %v", err)
+			}
+			if data, err := os.ReadFile(sibling); err != nil || string(data) != "keep" {
+				t.Fatalf("file outside the extraction root was touched: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyLayerWhiteoutReplacesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := layerTar(t,
+		&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+		&tar.Header{Name: "link/.wh.victim", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: ".wh.link", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	if err := ApplyLayer(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("whiteout below a symlink removed a file outside the root: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isWhiteout(info) {
+		t.Fatalf("link was not replaced by a whiteout, mode %v", info.Mode())
+	}
+}
@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds the number of symbolic links followed while resolving
+// a path, like the kernel's limit for path lookups.
+const maxSymlinks = 255
+
+// cleanName validates the name of an archive entry and returns it as a
+// clean path relative to the extraction root. Absolute names and names
+// that leave the root through ".." are rejected.
+func cleanName(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid archive entry %q: absolute paths are not allowed", name)
+	}
+	cleaned := filepath.Clean(name)
+	if cleaned == "." {
+		return cleaned, nil
+	}
+	if !filepath.IsLocal(cleaned) {
+		return "", fmt.Errorf("invalid archive entry %q: path escapes the destination directory", name)
+	}
+	return cleaned, nil
+}
+
+// SecureJoin joins the relative path name to root, resolving symbolic links
+// as if root were the filesystem root. Links are never followed out of
+// root: an absolute link target restarts at root and ".." stops at root.
+// Components that do not exist are appended unresolved.
+func SecureJoin(root, name string) (string, error) {
+	var resolved string // path relative to root, without symlinks
+	remaining := name
+	links := 0
+
+	for remaining != "" {
+		var component string
+		component, remaining, _ = strings.Cut(remaining, string(filepath.Separator))
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many symbolic links resolving %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = filepath.Join(target, remaining)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
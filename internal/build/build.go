@@ -5,10 +5,31 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/container"
+	"github.com/lariskovski/containy/internal/fsutil"
+	"github.com/lariskovski/containy/internal/ignore"
+	"github.com/lariskovski/containy/internal/image"
 )
 
+// Options holds the user supplied settings for a build.
+type Options struct {
+	// RunOptions are applied to the containers executing RUN instructions
+	RunOptions container.Options
+
+	// Tags are the names given to the built image, e.g. "myapp:1.2"
+	Tags []string
+
+	// File is the build file, by default TainyFile in the build context
+	File string
+
+	// Secrets are the secrets available to RUN --mount=type=secret, given
+	// as id=<id>,src=<file>
+	Secrets []string
+}
+
 // BuildState maintains context during a container image build.
 // It tracks the current layer and instruction being processed,
 // allowing instructions to build upon previous ones.
@@ -18,22 +39,75 @@ type BuildState struct {
 
 	// CurrentInstructionType stores the type of the most recently executed instruction
 	CurrentInstructionType string
+
+	// Layers are the layers of the current stage, from the base layer to CurrentLayer
+	Layers []Layer
+
+	// History records the instructions of the current stage
+	History []image.History
+
+	// Config collects the image configuration set by metadata instructions (e.g. VOLUME)
+	Config image.Config
+
+	// Options are the user supplied build settings
+	Options Options
+
+	// ContextDir is the directory local paths in instructions are relative to
+	ContextDir string
+
+	// Ignore excludes the files of the build context listed in its .tainyignore
+	Ignore *ignore.Matcher
+
+	// Stages holds the layer IDs of the completed stages, by index
+	Stages [][]string
+
+	// Secrets maps the IDs of the build secrets to their files
+	Secrets map[string]string
 }
 
 // Build parses a container build file and executes its instructions to build an image.
-// The file at 'filepath' should contain container build instructions (e.g., FROM, RUN).
+// contextArg is the build context: a directory, a tar archive, or "-" for an archive
+// read from standard input. The build file, opts.File or TainyFile in the context,
+// should contain container build instructions (e.g., FROM, RUN).
 // Each instruction is parsed, converted to the instructions.Instruction interface, and executed in order.
 // If any instruction fails, the build process is aborted and an error is logged.
-func Build(filepath, alias string) error {
-	config.Log.Infof("Building container from file: %s", filepath)
+func Build(contextArg string, opts Options) error {
+	// Validate the tags up front rather than failing after a long build
+	for _, tag := range opts.Tags {
+		ref, err := image.ParseReference(tag)
+		if err != nil {
+			return err
+		}
+		if ref.Digest != "" {
+			return fmt.Errorf("invalid tag %q: a build tag cannot contain a digest", tag)
+		}
+	}
+
+	if err := container.ValidateNetwork(opts.RunOptions.Network); err != nil {
+		return err
+	}
 
 	// Parse the build file into a slice of parser.Line instructions
-	instructions, err := parse(filepath)
+	contextDir, file, cleanup, err := openContext(contextArg, opts.File)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	config.Log.Infof("Building container from file: %s", file)
+
+	instructions, err := parse(file)
 	if err != nil {
 		return fmt.Errorf("failed to parse file: %w", err)
 	}
 
-	buildState := &BuildState{}
+	secrets, err := parseSecrets(opts.Secrets)
+	if err != nil {
+		return err
+	}
+	buildState := &BuildState{Options: opts, ContextDir: contextDir, Secrets: secrets}
+	if buildState.Ignore, err = ignore.Load(buildState.ContextDir, file); err != nil {
+		return err
+	}
 
 	for step, instruction := range instructions {
 		instructionType := instruction.GetType()
@@ -46,15 +120,25 @@ func Build(filepath, alias string) error {
 
 		config.Log.Infof("STEP %d: %s %s", step+1, instructionType, instructionArgs)
 
-		id := GenerateHexID(strings.Join([]string{instructionType, instructionArgs}, " "))
-		if checkIfLayerExists(id) {
+		// FROM starts a new stage with a fresh layer stack and configuration
+		if instructionType == "FROM" {
+			startStage(buildState)
+		}
+
+		// FROM, COPY, ADD and RUN look up their own cached layer, as the
+		// layer's ID depends on the content they add or mount rather than on
+		// the instruction alone
+		createdBy := strings.Join([]string{instructionType, instructionArgs}, " ")
+		id := layerID(buildState, createdBy)
+		if !contentAddressed[instructionType] && checkIfLayerExists(id) {
 			config.Log.Infof("Layer is cached: %s", id)
 			// Load the cached layer and update build state
-			cachedLayer, err := loadCachedLayer(id)
+			cachedLayer, err := loadCachedLayer(buildLowerDir(buildState), id)
 			if err != nil {
 				return fmt.Errorf("failed to load cached layer %s: %w", id, err)
 			}
 			updateBuildState(buildState, cachedLayer, instructionType)
+			addHistory(buildState, createdBy, cachedLayer)
 			continue
 		}
 
@@ -67,31 +151,74 @@ func Build(filepath, alias string) error {
 		}
 		config.Log.Debugf("Instruction executed successfully: %s", instructionType)
 
+		// Metadata instructions (e.g. VOLUME) only update the image config
+		// and return the current layer unchanged. FROM an existing image
+		// adopts that image's layers and history instead
+		if layer == buildState.CurrentLayer {
+			if instructionType != "FROM" {
+				addHistory(buildState, createdBy, nil)
+			}
+			continue
+		}
+
 		// Update the build state with the new layer and instruction
 		updateBuildState(buildState, layer, instructionType)
+		addHistory(buildState, createdBy, layer)
 	}
 
-	// Create an alias for the last layer if specified
-	// This is useful for tagging the final image with a name
-	// and version (e.g., "myimage:latest")
-	// If no alias is provided, use the layer ID as the alias
-	// This allows users to refer to the final image by a friendly name
-	// instead of a hash
-	if buildState.CurrentLayer != nil {
-		finalAlias := alias
-		if finalAlias == "" {
-			finalAlias = buildState.CurrentLayer.GetID()
-		}
-		if err := buildState.CurrentLayer.CreateAlias(finalAlias); err != nil {
-			return fmt.Errorf("failed to create alias for layer %s: %w", buildState.CurrentLayer.GetID(), err)
+	if buildState.CurrentLayer == nil {
+		return fmt.Errorf("no FROM instruction found in %s", file)
+	}
+
+	img, err := saveImage(buildState)
+	if err != nil {
+		return err
+	}
+	config.Log.Infof("Built image %s", img.ShortID())
+
+	// Tag the image with the requested names. This is useful for naming
+	// the final image (e.g., "myimage:1.2") instead of referring to it by ID
+	for _, tag := range opts.Tags {
+		if err := image.Tag(tag, img.ID); err != nil {
+			return fmt.Errorf("failed to tag image %s: %w", img.ShortID(), err)
 		}
-		config.Log.Infof("Created alias %s -> %s", finalAlias, buildState.CurrentLayer.GetMergedDir())
+		config.Log.Infof("Tagged %s -> %s", tag, img.ShortID())
 	}
 
 	config.Log.Infof("Container build completed successfully.")
 	return nil
 }
 
+// saveImage writes the manifest of the image built from the current stage
+// to the image store. An image identical to one built before, apart from
+// its timestamps, is not saved again; the stored one is returned instead.
+func saveImage(state *BuildState) (*image.Image, error) {
+	img := &image.Image{
+		Config:  state.Config,
+		Created: time.Now().UTC(),
+		History: state.History,
+	}
+	for _, layer := range state.Layers {
+		img.Layers = append(img.Layers, layer.GetID())
+	}
+	for _, h := range state.History {
+		img.Size += h.Size
+	}
+
+	previous, err := image.FindRebuilt(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up previous builds: %w", err)
+	}
+	if previous != nil {
+		return previous, nil
+	}
+
+	if err := image.Save(img); err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+	return img, nil
+}
+
 // isValidCommand checks if an instruction type is supported by the system.
 // It verifies the instruction against the handlers map to determine if
 // there's an implementation available for the instruction.
@@ -117,8 +244,70 @@ func GenerateHexID(input string) string {
 	return hexString[:length]
 }
 
+// layerID derives the ID of the layer an instruction produces from the
+// instruction and the layer it is built upon, so identical instructions
+// on different parents never share a cached layer.
+func layerID(state *BuildState, instruction string) string {
+	if state.CurrentLayer == nil {
+		return GenerateHexID(instruction)
+	}
+	return GenerateHexID(state.CurrentLayer.GetID() + " " + instruction)
+}
+
+// adoptImage makes the layers, configuration and history of an existing
+// image the base of the current stage.
+func adoptImage(state *BuildState, img *image.Image) error {
+	for _, id := range img.Layers {
+		lowerDir := ""
+		if state.CurrentLayer != nil {
+			lowerDir = buildLowerDir(state)
+		}
+		layer, err := loadCachedLayer(lowerDir, id)
+		if err != nil {
+			return fmt.Errorf("failed to load layer %s: %w", id, err)
+		}
+		updateBuildState(state, layer, "FROM")
+	}
+	state.Config = img.Config
+	state.History = append([]image.History{}, img.History...)
+	return nil
+}
+
+// startStage resets the build state for a new FROM instruction, recording
+// the layers of the completed stage.
+func startStage(state *BuildState) {
+	if state.CurrentLayer != nil {
+		var ids []string
+		for _, layer := range state.Layers {
+			ids = append(ids, layer.GetID())
+		}
+		state.Stages = append(state.Stages, ids)
+	}
+	state.CurrentLayer = nil
+	state.CurrentInstructionType = ""
+	state.Layers = nil
+	state.History = nil
+	state.Config = image.Config{}
+}
+
 func updateBuildState(state *BuildState, layer Layer, instructionType string) {
 	state.CurrentLayer = layer
 	state.CurrentInstructionType = instructionType
+	state.Layers = append(state.Layers, layer)
 	config.Log.Debugf("Updated build state to current layer: %s", layer.GetID())
 }
+
+// addHistory records an instruction in the image history. layer is nil
+// for instructions that only change the image configuration.
+func addHistory(state *BuildState, createdBy string, layer Layer) {
+	h := image.History{Created: time.Now().UTC(), CreatedBy: createdBy, EmptyLayer: layer == nil}
+	if layer != nil {
+		h.LayerID = layer.GetID()
+		size, err := fsutil.DirSize(layer.GetDiffDir())
+		if err != nil {
+			config.Log.Warnf("Failed to compute size of layer %s: %v", layer.GetID(), err)
+		}
+		h.Size = size
+	}
+	state.History = append(state.History, h)
+}
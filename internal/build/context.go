@@ -0,0 +1,270 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// DefaultFile is the name of the build file looked up in the build context.
+const DefaultFile = "TainyFile"
+
+// openContext prepares the build context named by arg, which is one of:
+//   - a directory
+//   - "-", a tar archive read from standard input
+//   - the path of a tar archive, uncompressed or compressed with any
+//     supported format
+//
+// Archives are extracted into a temporary directory, which the returned
+// cleanup function removes. file names the build file: on the host for a
+// directory context, and inside the archive for an archive context. It
+// defaults to TainyFile at the root of the context.
+//
+// For compatibility with earlier versions, a build file given in place of
+// the context builds with the file's directory as the context.
+//
+// Parameters:
+//   - arg: The build context
+//   - file: The build file, or "" for the default
+//
+// Returns:
+//   - string: The directory holding the context
+//   - string: The path of the build file
+//   - func(): Removes the temporary files of the context
+//   - error: Any error encountered while reading the context
+func openContext(arg, file string) (string, string, func(), error) {
+	noCleanup := func() {}
+	if arg == "-" {
+		return extractContext(os.Stdin, file)
+	}
+
+	info, err := os.Stat(arg)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to open build context: %w", err)
+	}
+	if info.IsDir() {
+		if file == "" {
+			file = filepath.Join(arg, DefaultFile)
+		}
+		return arg, file, noCleanup, nil
+	}
+
+	isArchive, err := isTarArchive(arg)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !isArchive {
+		if file != "" {
+			return "", "", nil, fmt.Errorf("build context %s is neither a directory nor a tar archive", arg)
+		}
+		config.Log.Warnf("Passing the build file as the context is deprecated, use: build -f %s %s", arg, filepath.Dir(arg))
+		return filepath.Dir(arg), arg, noCleanup, nil
+	}
+
+	f, err := os.Open(arg)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to open build context: %w", err)
+	}
+	defer f.Close()
+	return extractContext(f, file)
+}
+
+// extractContext extracts a build context archive into a temporary
+// directory and locates the build file in it.
+func extractContext(r io.Reader, file string) (string, string, func(), error) {
+	dir, err := os.MkdirTemp("", "containy-context-")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to create context directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	dr, err := archive.Decompress(r)
+	if err != nil {
+		cleanup()
+		return "", "", nil, fmt.Errorf("failed to read build context: %w", err)
+	}
+	defer dr.Close()
+	if err := archive.Extract(dr, dir); err != nil {
+		cleanup()
+		return "", "", nil, fmt.Errorf("failed to extract build context: %w", err)
+	}
+
+	if file == "" {
+		file = DefaultFile
+	}
+	path, err := archive.SecureJoin(dir, filepath.Clean("/"+file))
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	return dir, path, cleanup, nil
+}
+
+// contextSources resolves a source of a COPY or ADD instruction to the
+// files of the build context it names. The source may contain glob
+// patterns and is confined to the context: a leading "/" or ".." cannot
+// leave it, and symbolic links are resolved with the context as the root
+// directory. Files excluded by the context's .tainyignore do not match.
+func contextSources(state *BuildState, src string) ([]string, error) {
+	globbed, err := globContext(state, src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s: %w", src, err)
+	}
+
+	var matches []string
+	for _, match := range globbed {
+		if !state.Ignore.Excludes(match) {
+			matches = append(matches, match)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory in the build context", src)
+	}
+	return matches, nil
+}
+
+// globContext returns the paths of the build context matching pattern,
+// with the syntax of filepath.Match in each component. Unlike
+// filepath.Glob, directories are listed after resolving the symbolic
+// links leading to them within the context (see resolveContextPath).
+func globContext(state *BuildState, pattern string) ([]string, error) {
+	rel := strings.TrimPrefix(filepath.Clean("/"+pattern), "/")
+
+	// paths are context relative, their symbolic links still unresolved
+	paths := []string{"."}
+	if rel != "" {
+		for _, part := range strings.Split(rel, "/") {
+			if !strings.ContainsAny(part, `*?[\`) {
+				for i := range paths {
+					paths[i] = filepath.Join(paths[i], part)
+				}
+				continue
+			}
+			if _, err := filepath.Match(part, ""); err != nil {
+				return nil, err
+			}
+
+			var next []string
+			for _, p := range paths {
+				dir, err := archive.SecureJoin(state.ContextDir, p)
+				if err != nil {
+					return nil, err
+				}
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					if ok, _ := filepath.Match(part, entry.Name()); ok {
+						next = append(next, filepath.Join(p, entry.Name()))
+					}
+				}
+			}
+			paths = next
+		}
+	}
+
+	var matches []string
+	seen := map[string]bool{}
+	for _, p := range paths {
+		resolved, err := resolveContextPath(state, p)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(resolved); err == nil && !seen[resolved] {
+			seen[resolved] = true
+			matches = append(matches, resolved)
+		}
+	}
+	return matches, nil
+}
+
+// resolveContextPath resolves the symbolic links in a context relative
+// path as if the build context were the root directory, so that a link
+// such as "link -> /" or "link -> ../.." cannot lead out of it. The last
+// component is not resolved: a symbolic link is copied as a link.
+func resolveContextPath(state *BuildState, rel string) (string, error) {
+	parent, err := archive.SecureJoin(state.ContextDir, filepath.Dir(rel))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", rel, err)
+	}
+	return filepath.Join(parent, filepath.Base(rel)), nil
+}
+
+// hashSources returns a digest of the files and directories to be copied
+// by an instruction, so that its layer is rebuilt when their content
+// changes. The digest covers the names, modes, file contents and link
+// targets; timestamps and ownership are ignored, as they change without
+// the content changing (e.g. on a fresh checkout).
+func hashSources(sources []source) (string, error) {
+	h := sha256.New()
+	for _, src := range sources {
+		fmt.Fprintf(h, "source extract=%t\n", src.extract)
+
+		err := walkSource(src, func(path string, d fs.DirEntry) error {
+			// A file source is copied under its own name, while a directory
+			// source only contributes its content: the name and mode of the
+			// directory itself, e.g. of an extracted context, do not matter
+			rel, err := filepath.Rel(src.path, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				if d.IsDir() {
+					return nil
+				}
+				rel = filepath.Base(path)
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %o\n", rel, info.Mode())
+
+			switch {
+			case info.Mode().IsRegular():
+				digest, err := fileDigest(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(h, digest)
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(h, link)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", src.path, err)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkSource calls fn for the files and directories of a source, in
+// lexical order, skipping those excluded by the context's .tainyignore.
+func walkSource(src source, fn func(path string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(src.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if src.ignore.Excludes(path) {
+			if d.IsDir() && src.ignore.SkipsDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, d)
+	})
+}
@@ -0,0 +1,407 @@
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/download"
+	"github.com/lariskovski/containy/internal/fsutil"
+	"github.com/lariskovski/containy/internal/ignore"
+	"github.com/lariskovski/containy/internal/user"
+)
+
+// source is a file or directory copied into a layer by COPY or ADD.
+type source struct {
+	// path is the location of the source on the host: in the build context,
+	// or in a staging directory for downloaded URLs
+	path string
+
+	// extract marks a tar archive whose content is copied instead of the file
+	extract bool
+
+	// ignore excludes files of the build context, nil for downloads
+	ignore *ignore.Matcher
+}
+
+// copyOptions are the ownership and permissions given to copied files.
+type copyOptions struct {
+	// chown is the --chown user[:group] specification, "" for root
+	chown string
+
+	// chmod is the --chmod value; mode holds the permissions it sets
+	chmod string
+	mode  os.FileMode
+
+	// uid and gid are the owner resolved from chown
+	uid, gid int
+}
+
+// copyCmd implements the COPY instruction from a container build file.
+// It copies files and directories of the build context into a new layer:
+//
+//	COPY <src>... <dest>
+//
+// Sources are relative to the build context and may contain glob patterns;
+// a directory source copies the directory's content. Files excluded by the
+// context's .tainyignore are neither copied nor part of the cache key. The destination is
+// relative to the working directory of the image, and is a directory if it
+// ends with "/" or already exists as one.
+//
+// Copied files are owned by root unless --chown=user[:group] is given, by
+// name in the image's /etc/passwd and /etc/group or by numeric ID; a user
+// without a group also sets the group ID to the user ID. --chmod=<octal>
+// sets the permissions of the copied files and directories.
+//
+// The layer is identified by the content of the sources, so editing a
+// source file rebuilds it while an unchanged context reuses the cache.
+//
+// Parameters:
+//   - arg: The sources and destination, as words or a JSON array
+//   - state: The current build state containing layer information
+//
+// Returns:
+//   - Layer: The new layer holding the copied files
+//   - error: Any error encountered while copying
+func copyCmd(arg string, state *BuildState) (Layer, error) {
+	config.Log.Debugf("Processing COPY instruction with argument: %s", arg)
+	return addFiles("COPY", arg, state)
+}
+
+// add implements the ADD instruction from a container build file. It
+// copies sources like COPY, with two additions:
+//   - local tar archives, uncompressed or compressed with any supported
+//     format, are extracted into the destination directory
+//   - http:// and https:// URLs are downloaded into the destination, through
+//     the download cache; --checksum=sha256:<hex> verifies a single URL
+//
+// --chown and --chmod apply as for COPY, except to the content of extracted
+// archives, which keeps the ownership and permissions recorded in them.
+//
+// Parameters:
+//   - arg: The flags, sources and destination
+//   - state: The current build state containing layer information
+//
+// Returns:
+//   - Layer: The new layer holding the added files
+//   - error: Any error encountered while downloading, extracting or copying
+func add(arg string, state *BuildState) (Layer, error) {
+	config.Log.Debugf("Processing ADD instruction with argument: %s", arg)
+	return addFiles("ADD", arg, state)
+}
+
+// addFiles implements COPY and ADD, named by kind.
+func addFiles(kind, arg string, state *BuildState) (Layer, error) {
+	if state.CurrentLayer == nil {
+		return nil, fmt.Errorf("%s requires a preceding FROM instruction", kind)
+	}
+
+	allowed := []string{"chown", "chmod"}
+	if kind == "ADD" {
+		allowed = append(allowed, "checksum")
+	}
+	flags, arg, err := parseFlags(arg, allowed...)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := parseChecksum(flags["checksum"])
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseCopyOptions(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := parseListArgs(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%s requires at least one source and a destination", kind)
+	}
+	srcs, dest := args[:len(args)-1], args[len(args)-1]
+	if checksum != "" && (len(srcs) != 1 || !isURL(srcs[0])) {
+		return nil, fmt.Errorf("--checksum is only supported for a single URL source")
+	}
+
+	// Downloads are staged outside the layer, so that they are hashed and
+	// copied like files of the build context
+	staging, err := os.MkdirTemp("", "containy-add-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	var sources []source
+	for i, src := range srcs {
+		if isURL(src) {
+			if kind != "ADD" {
+				return nil, fmt.Errorf("COPY does not support URLs, use ADD: %s", src)
+			}
+			dir := filepath.Join(staging, fmt.Sprint(i))
+			path, err := fetchSource(src, checksum, dir)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source{path: path})
+			continue
+		}
+
+		matches, err := contextSources(state, src)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			src := source{path: match, ignore: state.Ignore}
+			// Only regular files are extracted: a symbolic link is copied
+			// as a link, not followed to an archive outside the context
+			if info, err := os.Lstat(match); kind == "ADD" && err == nil && info.Mode().IsRegular() {
+				if src.extract, err = isTarArchive(match); err != nil {
+					return nil, err
+				}
+			}
+			sources = append(sources, src)
+		}
+	}
+
+	// Docker requires a directory destination for several sources rather
+	// than guessing which of them the destination names
+	if len(sources) > 1 && !strings.HasSuffix(dest, "/") {
+		return nil, fmt.Errorf("%s with more than one source requires a destination directory ending with /", kind)
+	}
+	if !path.IsAbs(dest) {
+		workDir := state.Config.WorkingDir
+		if workDir == "" {
+			workDir = "/"
+		}
+		dest = path.Join(workDir, dest) + suffixSlash(dest)
+	}
+
+	digest, err := hashSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	// Ownership and permissions are part of the layer's identity: changing
+	// them rebuilds the layer even though the sources are unchanged
+	inst := kind
+	if opts.chown != "" {
+		inst += " --chown=" + opts.chown
+	}
+	if opts.chmod != "" {
+		inst += " --chmod=" + opts.chmod
+	}
+	id := layerID(state, inst+" "+digest+" "+dest)
+	if checkIfLayerExists(id) {
+		config.Log.Infof("Layer is cached: %s", id)
+		return loadCachedLayer(buildLowerDir(state), id)
+	}
+
+	layer, err := AddNewLayer(buildLowerDir(state), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new layer: %w", err)
+	}
+	if err := opts.resolveOwner(layer.GetMergedDir()); err != nil {
+		removeLayer(layer)
+		return nil, err
+	}
+	for _, src := range sources {
+		if err := copySource(layer.GetMergedDir(), src, dest, opts); err != nil {
+			removeLayer(layer)
+			return nil, fmt.Errorf("failed to copy %s: %w", filepath.Base(src.path), err)
+		}
+	}
+
+	if err := layer.Unmount(); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// parseCopyOptions parses the --chown and --chmod flags of COPY and ADD.
+func parseCopyOptions(flags map[string][]string) (copyOptions, error) {
+	var opts copyOptions
+	if len(flags["chown"]) > 1 || len(flags["chmod"]) > 1 {
+		return opts, fmt.Errorf("--chown and --chmod may only be given once")
+	}
+	if len(flags["chown"]) == 1 {
+		opts.chown = flags["chown"][0]
+	}
+	if len(flags["chmod"]) == 1 {
+		opts.chmod = flags["chmod"][0]
+		bits, err := strconv.ParseUint(opts.chmod, 8, 32)
+		if err != nil || bits > 07777 {
+			return opts, fmt.Errorf("invalid --chmod %q: expected an octal mode such as 0755", opts.chmod)
+		}
+		opts.mode = os.FileMode(bits & 0777)
+		if bits&04000 != 0 {
+			opts.mode |= os.ModeSetuid
+		}
+		if bits&02000 != 0 {
+			opts.mode |= os.ModeSetgid
+		}
+		if bits&01000 != 0 {
+			opts.mode |= os.ModeSticky
+		}
+	}
+	return opts, nil
+}
+
+// resolveOwner resolves the --chown specification against the passwd and
+// group files of the root filesystem at root.
+func (o *copyOptions) resolveOwner(root string) error {
+	if o.chown == "" {
+		return nil
+	}
+	u, err := user.Lookup(root, o.chown)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --chown: %w", err)
+	}
+	o.uid, o.gid = int(u.Uid), int(u.Gid)
+	if !strings.Contains(o.chown, ":") {
+		o.gid = int(u.Uid)
+	}
+	return nil
+}
+
+// setMode applies the --chmod permissions to a copied entry. Symbolic
+// links have no permissions of their own and are left unchanged.
+func (o copyOptions) setMode(path string, info fs.FileInfo) error {
+	if o.chmod == "" || info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(path, o.mode)
+}
+
+// isURL reports whether an ADD source is a URL to download.
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// suffixSlash returns "/" if p ends with one, as path.Join drops it.
+func suffixSlash(p string) string {
+	if strings.HasSuffix(p, "/") && p != "/" {
+		return "/"
+	}
+	return ""
+}
+
+// fetchSource downloads an ADD source into dir, naming the file after the
+// last element of the URL's path.
+func fetchSource(src, checksum, dir string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %s: %w", src, err)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", fmt.Errorf("cannot determine a file name from %s", src)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	body, err := download.Open(src, checksum)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	target := filepath.Join(dir, name)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.ReadFrom(body); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", src, err)
+	}
+	return target, nil
+}
+
+// copySource copies a source into the root filesystem at root. dest is
+// the absolute destination in the container; symbolic links in it resolve
+// within root.
+func copySource(root string, src source, dest string, opts copyOptions) error {
+	info, err := os.Lstat(src.path)
+	if err != nil {
+		return err
+	}
+
+	// Sources are copied into a directory destination under their own name,
+	// while directories and archives contribute their content
+	if !src.extract && !info.IsDir() {
+		existing, err := archive.SecureJoin(root, dest)
+		if err != nil {
+			return err
+		}
+		if st, err := os.Stat(existing); strings.HasSuffix(dest, "/") || (err == nil && st.IsDir()) {
+			return copyEntry(root, src.path, path.Join(dest, filepath.Base(src.path)), info, opts)
+		}
+		return copyEntry(root, src.path, dest, info, opts)
+	}
+
+	dir, err := archive.SecureJoin(root, dest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		// A destination directory created by the copy belongs to its owner
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.Lchown(dir, opts.uid, opts.gid); err != nil {
+			return err
+		}
+		if err := opts.setMode(dir, info); err != nil {
+			return err
+		}
+	}
+	if src.extract {
+		return extractArchive(src.path, dir)
+	}
+
+	return walkSource(src, func(p string, d fs.DirEntry) error {
+		rel, err := filepath.Rel(src.path, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyEntry(root, p, path.Join(dest, filepath.ToSlash(rel)), info, opts)
+	})
+}
+
+// copyEntry copies a single file, directory or symbolic link to the path
+// target of the root filesystem at root, replacing what is there unless
+// both are directories. Only the parent of target is resolved through
+// symbolic links, so that a link at target is replaced rather than followed.
+func copyEntry(root, src, target string, info fs.FileInfo, opts copyOptions) error {
+	parent, err := archive.SecureJoin(root, path.Dir(target))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(parent, path.Base(target))
+
+	if existing, err := os.Lstat(dst); err == nil && !(existing.IsDir() && info.IsDir()) {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+	}
+	if err := fsutil.CopyEntryWithOwner(src, dst, info, opts.uid, opts.gid); err != nil {
+		return err
+	}
+	return opts.setMode(dst, info)
+}
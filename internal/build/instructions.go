@@ -2,9 +2,15 @@ package build
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/lariskovski/containy/internal/config"
 	"github.com/lariskovski/containy/internal/container"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/lariskovski/containy/internal/registry"
 )
 
 // Instruction represents a single directive in a container build file.
@@ -26,12 +32,21 @@ type Instruction struct {
 // To add support for a new instruction type, add an entry to this map
 // with a handler function that implements the instruction's behavior.
 var handlers = map[string]func(string, *BuildState) (Layer, error){
-	"FROM": from,
-	"RUN":  runCmd,
-	// "COPY": copyCmd,
+	"FROM":   from,
+	"RUN":    runCmd,
+	"VOLUME": volume,
+	"LABEL":  label,
+	"COPY":   copyCmd,
+	"ADD":    add,
 	// "CMD":  cmd,
 }
 
+// contentAddressed lists the instructions whose layer ID is derived from
+// the content they add rather than from the instruction text alone: FROM
+// from its base, COPY and ADD from their sources, and RUN from the files
+// it bind mounts. Their handlers look up their own cached layer.
+var contentAddressed = map[string]bool{"FROM": true, "COPY": true, "ADD": true, "RUN": true}
+
 // Execute processes a sequence of build instructions to create a container image.
 // It iterates through each instruction, checks its validity, and invokes
 // the appropriate handler function with the instruction's arguments.
@@ -52,38 +67,237 @@ func (i Instruction) execute(state *BuildState) (Layer, error) {
 	return handler(i.GetArgs(), state)
 }
 
-// The FROM instruction specifies the base image to use for the container.
-// Sets up the base layer for the container image by downloading and mounting the specified root filesystem.
-// It creates a new layer and mounts it to the specified directory.
-// The function also updates the BuildState with the current layer and instruction.
+// The FROM instruction specifies the base of a build stage, which is one of:
+//   - scratch, an empty base layer
+//   - the URL of a root filesystem tarball, downloaded into a new layer's
+//     lower directory and verified against --checksum=sha256:<hex> if given
+//   - a root filesystem tarball, `docker save` archive or OCI image layout,
+//     given as a path or file:// URL relative to the build context; tarballs
+//     are also verified against --checksum
+//   - an image, by name or ID, whose layers are reused; registry images
+//     that are not present locally are pulled
+//
+// Images adopt their layers, configuration and history as the base of the
+// stage and return the stage's current layer.
 func from(arg string, state *BuildState) (Layer, error) {
 	config.Log.Debugf("Processing FROM instruction with argument: %s", arg)
 
-	inst := "FROM " + arg
-	id := GenerateHexID(inst)
+	// Flags may precede or follow the base, e.g. FROM <url> --checksum=sha256:<hex>
+	flags, arg, err := parseFlags(arg, "checksum")
+	if err != nil {
+		return nil, err
+	}
+	if base, trailing, ok := strings.Cut(arg, " --"); ok {
+		more, rest, err := parseFlags("--"+trailing, "checksum")
+		if err != nil {
+			return nil, err
+		}
+		if rest != "" {
+			return nil, fmt.Errorf("unexpected argument after flags: %s", rest)
+		}
+		flags["checksum"] = append(flags["checksum"], more["checksum"]...)
+		arg = strings.TrimSpace(base)
+	}
+
+	checksum, err := parseChecksum(flags["checksum"])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case arg == "scratch" && checksum == "":
+		return fromScratch(state)
+	case strings.HasPrefix(arg, "file://"):
+		return fromFile(contextPath(state, strings.TrimPrefix(arg, "file://")), checksum, state)
+	case strings.Contains(arg, "://"):
+		return fromURL(arg, checksum, state)
+	}
+
+	if path := contextPath(state, arg); fileExists(path) {
+		return fromFile(path, checksum, state)
+	}
+	if checksum != "" {
+		return nil, fmt.Errorf("--checksum is only supported for root filesystem tarballs")
+	}
+	return fromImage(arg, state)
+}
+
+// fromScratch starts a stage from an empty base layer.
+func fromScratch(state *BuildState) (Layer, error) {
+	id := layerID(state, "FROM scratch")
+	if checkIfLayerExists(id) {
+		config.Log.Infof("Layer is cached: %s", id)
+		return loadCachedLayer("", id)
+	}
+	return AddEmptyBaseLayer(id)
+}
+
+// fromURL starts a stage from a root filesystem tarball downloaded from a
+// URL. A pinned checksum is part of the layer's identity, so changing it
+// downloads the tarball again rather than reusing the cached layer.
+func fromURL(url, checksum string, state *BuildState) (Layer, error) {
+	inst := "FROM " + url
+	if checksum != "" {
+		inst += " " + checksum
+	}
+	id := layerID(state, inst)
+	if checkIfLayerExists(id) {
+		config.Log.Infof("Layer is cached: %s", id)
+		return loadCachedLayer("", id)
+	}
 
 	// Create and setup overlay filesystem in one step using the Layer abstraction
-	layer, err := AddBaseLayer(id, arg)
+	layer, err := AddBaseLayer(id, url, checksum)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new layer: %w", err)
 	}
+	return layer, nil
+}
+
+// fromFile starts a stage from a local file, either an image archive or a
+// root filesystem tarball.
+func fromFile(path, checksum string, state *BuildState) (Layer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if info.IsDir() {
+		if checksum != "" {
+			return nil, fmt.Errorf("--checksum is only supported for root filesystem tarballs")
+		}
+		return fromArchive(path, state)
+	}
+
+	// The layer of a tarball is identified by the tarball's content, so that
+	// changing the file invalidates the cache. Hashing the file is cheaper
+	// than decompressing it to tell tarballs and image archives apart, so
+	// a cached tarball is found first
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" && digest != checksum {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", path, checksum, digest)
+	}
+	id := layerID(state, "FROM "+digest)
+	if checkIfLayerExists(id) {
+		config.Log.Infof("Layer is cached: %s", id)
+		return loadCachedLayer("", id)
+	}
 
+	isImage, err := oci.IsImageArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	if isImage {
+		if checksum != "" {
+			return nil, fmt.Errorf("--checksum is only supported for root filesystem tarballs")
+		}
+		return fromArchive(path, state)
+	}
+
+	layer, err := AddLocalBaseLayer(id, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new layer: %w", err)
+	}
 	return layer, nil
 }
 
+// fromArchive imports the image of a `docker save` archive or OCI image
+// layout and adopts it as the base of the stage. Layers imported before
+// are reused.
+func fromArchive(path string, state *BuildState) (Layer, error) {
+	imported, err := oci.Import(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import base image: %w", err)
+	}
+	if len(imported) != 1 {
+		return nil, fmt.Errorf("%s contains %d images, expected one", path, len(imported))
+	}
+
+	if err := adoptImage(state, imported[0].Image); err != nil {
+		return nil, err
+	}
+	return state.CurrentLayer, nil
+}
+
+// fromImage adopts a local image as the base of the stage. Images named
+// after a registry are pulled unless they are present locally.
+func fromImage(arg string, state *BuildState) (Layer, error) {
+	img, err := image.Resolve(arg)
+	if err != nil {
+		ref, parseErr := image.ParseReference(arg)
+		if parseErr != nil || ref.Domain == "" {
+			return nil, fmt.Errorf("base image %s is neither a file in the build context nor a local image: %w", arg, err)
+		}
+		config.Log.Debugf("Image %s not found locally: %v", ref, err)
+		if img, err = registry.Pull(ref, oci.DefaultPlatform()); err != nil {
+			return nil, fmt.Errorf("failed to pull base image: %w", err)
+		}
+	}
+
+	if err := adoptImage(state, img); err != nil {
+		return nil, err
+	}
+	return state.CurrentLayer, nil
+}
+
+// runNetwork returns the network mode of a RUN instruction: its --network
+// flag, or the default of the build.
+func runNetwork(state *BuildState, flags []string) (string, error) {
+	if len(flags) == 0 {
+		return state.Options.RunOptions.Network, nil
+	}
+	if len(flags) > 1 {
+		return "", fmt.Errorf("RUN accepts a single --network flag")
+	}
+	if err := container.ValidateNetwork(flags[0]); err != nil {
+		return "", err
+	}
+	return flags[0], nil
+}
+
+// contextPath resolves a path given in the build file against the build context.
+func contextPath(state *BuildState, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(state.ContextDir, path)
+}
+
 // runCmd implements the RUN instruction from a container build file.
 // It executes commands in a new container layer and captures any changes
 // to the filesystem.
 //
 // The function:
-// 1. Creates a unique layer ID based on the RUN command
+// 1. Creates a unique layer ID based on the RUN command and parent layer
 // 2. Builds the proper lowerdir path based on previous layers
 // 3. Creates and mounts a new overlay filesystem
 // 4. Executes the specified command inside the container
-// 5. Updates the build state with the new layer information
+// 5. Unmounts the overlay, keeping the changes in the layer's upper directory
+//
+// --mount=type=cache,target=<path>[,id=<id>][,sharing=shared|locked|private]
+// mounts a persistent cache directory at the target, e.g. for package
+// manager caches. Its content survives across builds without becoming
+// part of the layer; `containy builder prune` clears it.
+//
+// --mount=type=bind,target=<path>[,source=<path>][,from=<stage|image>][,rw]
+// mounts files of the build context, or of an earlier stage (by index) or
+// an image, without copying them into the layer. Their content is part of
+// the layer's identity. Writes to rw mounts are discarded.
+//
+// --mount=type=secret,id=<id>[,target=<path>][,required][,mode,uid,gid]
+// mounts the file of a build secret given with `build --secret`, by default
+// at /run/secrets/<id>. Secrets are held in memory and are neither part of
+// the layer nor of its identity.
+//
+// --network=none|host runs the command without network access, in a
+// network namespace of its own with only a loopback interface, or with the
+// host's network. It overrides the default given to `containy build
+// --network`, which is host. A step run without network is cached apart
+// from the same step run with it.
 //
 // Parameters:
-//   - arg: The command to execute (e.g., "apt-get update")
+//   - arg: The flags and the command to execute (e.g., "apt-get update")
 //   - state: The current build state containing layer information
 //
 // Returns:
@@ -91,8 +305,42 @@ func from(arg string, state *BuildState) (Layer, error) {
 func runCmd(arg string, state *BuildState) (Layer, error) {
 	config.Log.Debugf("Processing RUN instruction with argument: %s", arg)
 
+	if state.CurrentLayer == nil {
+		return nil, fmt.Errorf("RUN requires a preceding FROM instruction")
+	}
+
+	flags, command, err := parseFlags(arg, "mount", "network")
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := parseMounts(flags["mount"])
+	if err != nil {
+		return nil, err
+	}
+	network, err := runNetwork(state, flags["network"])
+	if err != nil {
+		return nil, err
+	}
+
+	// The flags are part of the layer's identity, like the command, and so
+	// are the content of bind mounted files and the network mode, which
+	// `build --network` may change without the flags showing it
 	inst := "RUN " + arg
-	id := GenerateHexID(inst)
+	if network != "" && network != "host" {
+		inst += " network=" + network
+	}
+	key, err := mountsKey(state, mounts)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		inst += " " + key
+	}
+	id := layerID(state, inst)
+	if checkIfLayerExists(id) {
+		config.Log.Infof("Layer is cached: %s", id)
+		return loadCachedLayer(buildLowerDir(state), id)
+	}
 
 	newLowerDir := buildLowerDir(state)
 
@@ -101,11 +349,97 @@ func runCmd(arg string, state *BuildState) (Layer, error) {
 		return nil, fmt.Errorf("failed to create new layer: %w", err)
 	}
 
-	command := prepareCommandArgs(layer.GetMergedDir(), arg)
-	// Consider: return an error if container.Create fails, instead of calling it directly
-	if err := container.Create(command); err != nil {
+	specs, releaseMounts, err := prepareMounts(state, mounts)
+	if err != nil {
+		removeLayer(layer)
+		return nil, err
+	}
+	defer releaseMounts()
+	mountpoints := container.MissingMountpoints(layer.GetMergedDir(), specs)
+
+	opts := runOptions(state)
+	opts.Mounts = specs
+	opts.Network = network
+	if err := container.Create(prepareCommandArgs(layer.GetMergedDir(), command), opts); err != nil {
+		removeLayer(layer)
 		return nil, fmt.Errorf("failed to execute command in container: %w", err)
 	}
+	container.RemoveMountpoints(layer.GetMergedDir(), mountpoints)
 
+	if err := layer.Unmount(); err != nil {
+		return nil, err
+	}
 	return layer, nil
 }
+
+// volume implements the VOLUME instruction from a container build file.
+// It records the given paths in the image configuration so that
+// `containy run` mounts an anonymous volume at each of them.
+// The paths may be given as a JSON array or separated by whitespace.
+//
+// VOLUME does not change the filesystem, so the current layer is returned
+// unchanged.
+//
+// Parameters:
+//   - arg: The container paths (e.g., "/var/lib/db" or ["/data", "/logs"])
+//   - state: The current build state containing the image configuration
+//
+// Returns:
+//   - error: Any error encountered while parsing the paths
+func volume(arg string, state *BuildState) (Layer, error) {
+	config.Log.Debugf("Processing VOLUME instruction with argument: %s", arg)
+
+	if state.CurrentLayer == nil {
+		return nil, fmt.Errorf("VOLUME requires a preceding FROM instruction")
+	}
+
+	paths, err := parseListArgs(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("VOLUME requires at least one path")
+	}
+
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("VOLUME path must be absolute: %s", p)
+		}
+		state.Config.AddVolume(p)
+	}
+
+	return state.CurrentLayer, nil
+}
+
+// label implements the LABEL instruction from a container build file.
+// It adds key/value metadata to the image configuration, e.g.
+// LABEL version=1.0 description="My image". Like VOLUME, it does not
+// change the filesystem.
+//
+// Parameters:
+//   - arg: One or more key=value pairs
+//   - state: The current build state containing the image configuration
+//
+// Returns:
+//   - error: Any error encountered while parsing the pairs
+func label(arg string, state *BuildState) (Layer, error) {
+	config.Log.Debugf("Processing LABEL instruction with argument: %s", arg)
+
+	if state.CurrentLayer == nil {
+		return nil, fmt.Errorf("LABEL requires a preceding FROM instruction")
+	}
+
+	pairs, err := parseKeyValues(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("LABEL requires at least one key=value pair")
+	}
+
+	for _, kv := range pairs {
+		state.Config.SetLabel(kv[0], kv[1])
+	}
+
+	return state.CurrentLayer, nil
+}
@@ -2,7 +2,10 @@ package build
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
+	"github.com/lariskovski/containy/internal/config"
 	"github.com/lariskovski/containy/internal/overlay"
 )
 
@@ -17,10 +20,12 @@ type Layer interface {
 	GetWorkDir() string
 	// GetMergedDir returns the merged directory of the layer
 	GetMergedDir() string
+	// GetDiffDir returns the directory holding the layer's own content
+	GetDiffDir() string
 	// Mount mounts the overlay filesystem
 	Mount() error
-	// CreateAlias creates an alias for the layer
-	CreateAlias(alias string) error
+	// Unmount unmounts the overlay filesystem
+	Unmount() error
 }
 
 func AddNewLayer(lowerDir, id string) (Layer, error) {
@@ -37,33 +42,95 @@ func AddNewLayer(lowerDir, id string) (Layer, error) {
 	return layer, nil
 }
 
-func AddBaseLayer(id, fsURL string) (Layer, error) {
+// AddBaseLayer creates a base layer from a root filesystem tarball
+// downloaded from fsURL. If checksum is not empty, the download must match
+// it, e.g. "sha256:<hex>".
+func AddBaseLayer(id, fsURL, checksum string) (Layer, error) {
+	return addExtractedBaseLayer(id, func(dir string) error {
+		if err := DownloadRootFS(fsURL, dir, checksum); err != nil {
+			return fmt.Errorf("failed to download root filesystem: %w", err)
+		}
+		return nil
+	})
+}
+
+// AddEmptyBaseLayer creates a base layer without content, for stages
+// starting FROM scratch.
+func AddEmptyBaseLayer(id string) (Layer, error) {
 	layer, err := overlay.NewOverlayFS("", id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup base layer: %w", err)
 	}
+	return layer, nil
+}
 
-	err = DownloadRootFS(fsURL, layer.GetLowerDir())
-	if err != nil {
-		return nil, fmt.Errorf("failed to download root filesystem: %w", err)
+// AddLocalBaseLayer creates a base layer from a local root filesystem
+// tarball. The archive may be uncompressed or gzip, bzip2, xz or zstd
+// compressed; the format is detected from its content.
+func AddLocalBaseLayer(id, path string) (Layer, error) {
+	return addExtractedBaseLayer(id, func(dir string) error {
+		if err := extractArchive(path, dir); err != nil {
+			return fmt.Errorf("failed to extract root filesystem: %w", err)
+		}
+		return nil
+	})
+}
+
+// addExtractedBaseLayer creates a base layer whose root filesystem is
+// extracted by extract into the directory it is given.
+//
+// The layer is assembled in a temporary directory next to the layers and
+// moved into place once the extraction succeeded, so that an interrupted
+// download or extraction does not leave a partial layer that the next build
+// takes for cached. The leftovers of an interrupted attempt are replaced.
+//
+// Parameters:
+//   - id: The ID of the layer
+//   - extract: Extracts the root filesystem into the given directory
+//
+// Returns:
+//   - Layer: The base layer
+//   - error: Any error encountered while extracting or moving the layer
+func addExtractedBaseLayer(id string, extract func(dir string) error) (Layer, error) {
+	tmp := config.BaseOverlayDir + "." + id + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, fmt.Errorf("failed to remove partial layer %s: %w", id, err)
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temporary layer directory: %w", err)
 	}
+	defer os.RemoveAll(tmp)
 
-	if err := layer.Mount(); err != nil {
-		return nil, fmt.Errorf("failed to mount base layer: %w", err)
+	if err := extract(filepath.Join(tmp, "lower")); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, config.BaseOverlayDir+id); err != nil {
+		return nil, fmt.Errorf("failed to move layer %s into place: %w", id, err)
 	}
 
+	layer, err := overlay.NewOverlayFS("", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup base layer: %w", err)
+	}
 	return layer, nil
 }
 
-func loadCachedLayer(id string) (Layer, error) {
-	layer, err := overlay.NewOverlayFS("", id)
+// loadCachedLayer loads a layer built previously. Cached layers are not
+// mounted: their content is only needed as a lower directory of later
+// layers and containers.
+func loadCachedLayer(lowerDir, id string) (Layer, error) {
+	layer, err := overlay.NewOverlayFS(lowerDir, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load cached layer: %w", err)
 	}
 
-	if err := layer.Mount(); err != nil {
-		return nil, fmt.Errorf("failed to mount cached layer: %w", err)
-	}
-
 	return layer, nil
-}
\ No newline at end of file
+}
+
+// removeLayer deletes a partially built layer, so that a failed
+// instruction is not mistaken for a cached layer by the next build.
+func removeLayer(layer Layer) {
+	if err := overlay.Remove(layer.GetID()); err != nil {
+		config.Log.Warnf("Failed to remove layer %s: %v", layer.GetID(), err)
+	}
+}
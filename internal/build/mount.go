@@ -0,0 +1,593 @@
+package build
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/container"
+	"github.com/lariskovski/containy/internal/fsutil"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/overlay"
+	"golang.org/x/sys/unix"
+)
+
+// runMount is a filesystem mounted into the container of a RUN instruction
+// with --mount. Mounts are not part of the layer built by the instruction.
+type runMount struct {
+	// kind is the mount type: "bind", "cache" or "secret"
+	kind string
+
+	// target is the absolute path of the mount in the container
+	target string
+
+	// readOnly mounts the filesystem read-only
+	readOnly bool
+
+	// id identifies a cache across instructions and builds, defaulting to
+	// the target, or names the build secret to mount
+	id string
+
+	// sharing controls concurrent use of a cache: "shared" by any number
+	// of builds, "locked" waits for exclusive use, and "private" uses a
+	// fresh directory while the cache is in use
+	sharing string
+
+	// source is the path of a bind mount in the build context, or in the
+	// filesystem of from
+	source string
+
+	// from is an earlier stage, by index, or an image to bind mount from
+	from string
+
+	// required fails the instruction if a secret was not given to the build
+	required bool
+
+	// mode, uid and gid are the permissions and owner of a secret file
+	mode     os.FileMode
+	uid, gid int
+}
+
+// mountOptions lists the options of each mount type, after resolving
+// aliases such as dst for target.
+var mountOptions = map[string][]string{
+	"bind":   {"target", "source", "from", "ro", "rw"},
+	"cache":  {"target", "id", "sharing", "ro", "rw"},
+	"secret": {"target", "id", "required", "mode", "uid", "gid"},
+}
+
+// mountAliases maps alternative option names to their canonical name.
+var mountAliases = map[string]string{
+	"dst":         "target",
+	"destination": "target",
+	"src":         "source",
+	"readonly":    "ro",
+	"readwrite":   "rw",
+}
+
+// parseMount parses the value of a RUN --mount flag, a comma separated
+// list of options such as "type=cache,target=/var/cache/apk,sharing=locked".
+// The type defaults to bind.
+func parseMount(spec string) (runMount, error) {
+	options := map[string]string{}
+	kind := "bind"
+	for _, option := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(option, "=")
+		if key == "type" {
+			kind = value
+			continue
+		}
+		if alias, ok := mountAliases[key]; ok {
+			key = alias
+		}
+		if !hasValue {
+			value = "true"
+		}
+		options[key] = value
+	}
+
+	allowed, ok := mountOptions[kind]
+	if !ok {
+		return runMount{}, fmt.Errorf("invalid mount %q: unsupported mount type %s", spec, kind)
+	}
+	for key := range options {
+		if !slices.Contains(allowed, key) {
+			return runMount{}, fmt.Errorf("invalid mount %q: unknown option %s for %s mounts", spec, key, kind)
+		}
+	}
+
+	m := runMount{
+		kind:    kind,
+		target:  options["target"],
+		id:      options["id"],
+		sharing: cmp.Or(options["sharing"], "shared"),
+		source:  cmp.Or(options["source"], "."),
+		from:    options["from"],
+		// Bind mounts are read-only unless rw is given
+		readOnly: kind != "cache",
+		mode:     0400,
+	}
+	for _, key := range []string{"ro", "rw", "required"} {
+		value, ok := options[key]
+		if !ok {
+			continue
+		}
+		set, err := strconv.ParseBool(value)
+		if err != nil {
+			return m, fmt.Errorf("invalid mount %q: invalid value for %s: %s", spec, key, value)
+		}
+		switch key {
+		case "ro":
+			m.readOnly = set
+		case "rw":
+			m.readOnly = !set
+		case "required":
+			m.required = set
+		}
+	}
+
+	var err error
+	switch kind {
+	case "cache":
+		if m.id == "" {
+			m.id = m.target
+		}
+		switch m.sharing {
+		case "shared", "locked", "private":
+		default:
+			return m, fmt.Errorf("invalid mount %q: sharing must be shared, locked or private", spec)
+		}
+	case "secret":
+		if m.id == "" {
+			return m, fmt.Errorf("invalid mount %q: a secret mount requires an id", spec)
+		}
+		if m.target == "" {
+			m.target = "/run/secrets/" + m.id
+		}
+		if value, ok := options["mode"]; ok {
+			mode, parseErr := strconv.ParseUint(value, 8, 32)
+			if parseErr != nil || mode > 0777 {
+				return m, fmt.Errorf("invalid mount %q: invalid mode %s", spec, value)
+			}
+			m.mode = os.FileMode(mode)
+		}
+		if m.uid, err = parseMountID(options, "uid"); err != nil {
+			return m, fmt.Errorf("invalid mount %q: %w", spec, err)
+		}
+		if m.gid, err = parseMountID(options, "gid"); err != nil {
+			return m, fmt.Errorf("invalid mount %q: %w", spec, err)
+		}
+	}
+
+	if !path.IsAbs(m.target) {
+		return m, fmt.Errorf("invalid mount %q: target must be an absolute path", spec)
+	}
+	m.target = path.Clean(m.target)
+	return m, nil
+}
+
+// parseMountID parses the numeric uid or gid option of a mount, 0 if unset.
+func parseMountID(options map[string]string, key string) (int, error) {
+	value, ok := options[key]
+	if !ok {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s", key, value)
+	}
+	return int(id), nil
+}
+
+// parseMounts parses the --mount flags of a RUN instruction.
+func parseMounts(specs []string) ([]runMount, error) {
+	var mounts []runMount
+	for _, spec := range specs {
+		m, err := parseMount(spec)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// mountsKey returns the part of a RUN instruction's cache key contributed
+// by its mounts: the content of the files bind mounted from the build
+// context, and the layers of the stages and images bind mounted from, so
+// that changing them runs the instruction again. Caches and secrets do not
+// contribute: they hold state the instruction's result must not depend on.
+func mountsKey(state *BuildState, mounts []runMount) (string, error) {
+	var key []string
+	for _, m := range mounts {
+		if m.kind != "bind" {
+			continue
+		}
+		if m.from != "" {
+			layers, err := stageLayers(state, m.from)
+			if err != nil {
+				return "", err
+			}
+			key = append(key, m.target+"="+strings.Join(layers, ","))
+			continue
+		}
+
+		src, err := bindContextSource(state, m.source)
+		if err != nil {
+			return "", err
+		}
+		digest, err := hashSources([]source{src})
+		if err != nil {
+			return "", err
+		}
+		key = append(key, m.target+"="+digest)
+	}
+	return strings.Join(key, " "), nil
+}
+
+// prepareMounts prepares the mounts of a RUN instruction for its
+// container. The returned function releases the resources held by the
+// mounts, such as cache locks and staging directories, once the container
+// has exited.
+//
+// Parameters:
+//   - state: The current build state with the build context and secrets
+//   - mounts: The parsed --mount flags
+//
+// Returns:
+//   - []container.Mount: The mounts to apply to the container
+//   - func(): Releases the mounts
+//   - error: Any error encountered while preparing the mounts
+func prepareMounts(state *BuildState, mounts []runMount) ([]container.Mount, func(), error) {
+	var specs []container.Mount
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	var secretDir string
+	for _, m := range mounts {
+		var hostPath string
+		var releaseMount func()
+		var err error
+
+		switch m.kind {
+		case "cache":
+			hostPath, releaseMount, err = acquireCache(m)
+		case "bind":
+			hostPath, releaseMount, err = bindSource(state, m)
+		case "secret":
+			file, ok := state.Secrets[m.id]
+			if !ok {
+				if m.required {
+					err = fmt.Errorf("secret %s is required but was not given with --secret", m.id)
+					break
+				}
+				config.Log.Debugf("Skipping mount of secret %s: not given", m.id)
+				continue
+			}
+			if secretDir == "" {
+				secretDir, releaseMount, err = createSecretDir()
+				if err != nil {
+					break
+				}
+				releases = append(releases, releaseMount)
+				releaseMount = nil
+			}
+			hostPath, err = writeSecret(secretDir, file, m, len(specs))
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if releaseMount != nil {
+			releases = append(releases, releaseMount)
+		}
+		specs = append(specs, container.Mount{Source: hostPath, Target: m.target, ReadOnly: m.readOnly})
+	}
+	return specs, release, nil
+}
+
+// acquireCache returns the directory of a cache mount, locked according
+// to its sharing mode, and the function releasing it.
+//
+// Caches live under config.CacheMountDir, in a directory named after the
+// cache's ID next to a lock file. Builds hold a shared lock while using a
+// cache and an exclusive lock for the locked and private modes, so that
+// Prune never removes a cache in use.
+func acquireCache(m runMount) (string, func(), error) {
+	dir, err := filepath.Abs(filepath.Join(config.CacheMountDir, GenerateHexID(m.id)))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create cache %s: %w", m.id, err)
+	}
+
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open lock of cache %s: %w", m.id, err)
+	}
+	unlock := func() { lock.Close() }
+
+	switch m.sharing {
+	case "shared":
+		err = unix.Flock(int(lock.Fd()), unix.LOCK_SH)
+	case "locked":
+		config.Log.Debugf("Waiting for exclusive use of cache %s", m.id)
+		err = unix.Flock(int(lock.Fd()), unix.LOCK_EX)
+	case "private":
+		err = unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == unix.EWOULDBLOCK {
+			// The cache is in use: start from an empty one, discarded afterwards
+			unlock()
+			config.Log.Infof("Cache %s is in use, using a private empty cache", m.id)
+			tmp, err := os.MkdirTemp("", "containy-cache-")
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to create private cache: %w", err)
+			}
+			return tmp, func() { os.RemoveAll(tmp) }, nil
+		}
+	}
+	if err != nil {
+		unlock()
+		return "", nil, fmt.Errorf("failed to lock cache %s: %w", m.id, err)
+	}
+	return dir, unlock, nil
+}
+
+// bindSource returns the host directory or file to bind mount for a bind
+// mount, and the function releasing it.
+//
+// Files of the build context are copied, so that the files excluded by the
+// .tainyignore stay hidden and writes never reach the context. Files of a
+// stage or image are mounted from a read-only view of its layers, or
+// copied too when the mount is writable; in both cases writes are
+// discarded with the copy.
+func bindSource(state *BuildState, m runMount) (string, func(), error) {
+	staging, err := os.MkdirTemp("", "containy-mount-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create mount directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(staging) }
+
+	if m.from == "" {
+		src, err := bindContextSource(state, m.source)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		copied := filepath.Join(staging, "source")
+		if err := copySourceTree(src, copied); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to copy mount source %s: %w", m.source, err)
+		}
+		return copied, cleanup, nil
+	}
+
+	layers, err := stageLayers(state, m.from)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	view, unmountView, err := mountLayers(layers, filepath.Join(staging, "view"))
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	release := func() {
+		unmountView()
+		cleanup()
+	}
+
+	hostPath, err := archive.SecureJoin(view, filepath.Clean("/"+m.source))
+	if err == nil {
+		_, err = os.Lstat(hostPath)
+	}
+	if err != nil {
+		release()
+		return "", nil, fmt.Errorf("mount source %s in %s: %w", m.source, m.from, err)
+	}
+	if !m.readOnly {
+		copied := filepath.Join(staging, "source")
+		if err := copySourceTree(source{path: hostPath}, copied); err != nil {
+			release()
+			return "", nil, fmt.Errorf("failed to copy mount source %s: %w", m.source, err)
+		}
+		hostPath = copied
+	}
+
+	if hostPath, err = filepath.Abs(hostPath); err != nil {
+		release()
+		return "", nil, err
+	}
+	return hostPath, release, nil
+}
+
+// bindContextSource resolves the source of a bind mount in the build
+// context, which is confined to the context like the sources of COPY:
+// symbolic links are resolved with the context as the root directory.
+// Unlike for COPY, a link in the last component is resolved too, as the
+// mount would follow it on the host.
+func bindContextSource(state *BuildState, src string) (source, error) {
+	p, err := archive.SecureJoin(state.ContextDir, filepath.Clean("/"+src))
+	if err != nil {
+		return source{}, fmt.Errorf("failed to resolve mount source %s: %w", src, err)
+	}
+	if _, err := os.Lstat(p); err != nil || state.Ignore.Excludes(p) {
+		return source{}, fmt.Errorf("%s: no such file or directory in the build context", src)
+	}
+	return source{path: p, ignore: state.Ignore}, nil
+}
+
+// copySourceTree copies a source, a file or a directory with its content,
+// to dst, keeping ownership and permissions.
+func copySourceTree(src source, dst string) error {
+	return walkSource(src, func(p string, d fs.DirEntry) error {
+		rel, err := filepath.Rel(src.path, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fsutil.CopyEntry(p, filepath.Join(dst, rel), info)
+	})
+}
+
+// stageLayers returns the layers of the filesystem a bind mount is taken
+// from: an earlier stage of the build, by index, or an image.
+func stageLayers(state *BuildState, from string) ([]string, error) {
+	if n, err := strconv.Atoi(from); err == nil {
+		if n < 0 || n >= len(state.Stages) {
+			return nil, fmt.Errorf("mount source %s is not an earlier stage of the build", from)
+		}
+		return state.Stages[n], nil
+	}
+	img, err := image.Resolve(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve mount source %s: %w", from, err)
+	}
+	return img.Layers, nil
+}
+
+// mountLayers returns a read-only view of the filesystem of layers, and
+// the function removing it. Several layers are stacked by an overlay
+// mounted at dir.
+func mountLayers(layers []string, dir string) (string, func(), error) {
+	if len(layers) == 1 {
+		return overlay.DiffDir(layers[0]), func() {}, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	if err := unix.Mount("overlay", dir, "overlay", unix.MS_RDONLY, "lowerdir="+overlay.LowerDirs(layers)); err != nil {
+		return "", nil, fmt.Errorf("failed to mount layers: %w", err)
+	}
+	return dir, func() { unix.Unmount(dir, unix.MNT_DETACH) }, nil
+}
+
+// createSecretDir mounts a private tmpfs holding the secrets of a RUN
+// instruction, so that they are never written to disk, and returns the
+// function removing it.
+func createSecretDir() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "containy-secrets-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create secret directory: %w", err)
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0700"); err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("failed to mount secret directory: %w", err)
+	}
+	return dir, func() {
+		unix.Unmount(dir, unix.MNT_DETACH)
+		os.Remove(dir)
+	}, nil
+}
+
+// writeSecret copies the file of a secret into the secret directory, with
+// the mount's owner and permissions, and returns its path. n numbers the
+// secrets of the instruction.
+func writeSecret(dir, file string, m runMount, n int) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", m.id, err)
+	}
+	dst := filepath.Join(dir, strconv.Itoa(n))
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write secret %s: %w", m.id, err)
+	}
+	if err := os.Chown(dst, m.uid, m.gid); err != nil {
+		return "", err
+	}
+	return dst, os.Chmod(dst, m.mode)
+}
+
+// parseSecrets parses the --secret flags of a build, of the form
+// id=<id>,src=<file>, into a map from secret IDs to files.
+func parseSecrets(specs []string) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, spec := range specs {
+		var id, file string
+		for _, option := range strings.Split(spec, ",") {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "id":
+				id = value
+			case "src", "source":
+				file = value
+			default:
+				return nil, fmt.Errorf("invalid secret %q: unknown option %s", spec, key)
+			}
+		}
+		if id == "" || file == "" {
+			return nil, fmt.Errorf("invalid secret %q: expected id=<id>,src=<file>", spec)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("invalid secret %s: %w", id, err)
+		}
+		secrets[id] = file
+	}
+	return secrets, nil
+}
+
+// Prune removes the cache directories of RUN --mount=type=cache and returns
+// the space they occupied. Caches in use by a build are kept.
+//
+// Returns:
+//   - int64: The number of bytes freed
+//   - error: Any error encountered while removing the caches
+func Prune() (int64, error) {
+	var freed int64
+
+	entries, err := os.ReadDir(config.CacheMountDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		size, err := pruneCache(filepath.Join(config.CacheMountDir, entry.Name()))
+		if err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// pruneCache removes a cache directory unless a build is using it.
+func pruneCache(dir string) (int64, error) {
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open lock of cache %s: %w", dir, err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		config.Log.Warnf("Skipping cache %s: in use", filepath.Base(dir))
+		return 0, nil
+	}
+
+	size, err := fsutil.DirSize(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, fmt.Errorf("failed to remove cache %s: %w", dir, err)
+	}
+	// The lock file goes last, while it is still held
+	os.Remove(dir + ".lock")
+	return size, nil
+}
@@ -2,8 +2,10 @@ package build
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -63,3 +65,87 @@ func (i Instruction) GetType() string {
 func (i Instruction) GetArgs() string {
 	return i.Args
 }
+
+// parseListArgs parses instruction arguments given either in JSON array
+// form (e.g. ["/data", "/logs"]) or as whitespace-separated words.
+func parseListArgs(arg string) ([]string, error) {
+	if strings.HasPrefix(arg, "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(arg), &list); err != nil {
+			return nil, fmt.Errorf("invalid JSON array %s: %w", arg, err)
+		}
+		return list, nil
+	}
+	return strings.Fields(arg), nil
+}
+
+// parseFlags separates the leading --name=value flags of instruction
+// arguments (e.g. "--checksum=sha256:<hex> <url>") from the remaining
+// arguments. Only the allowed flag names are accepted; a flag may be
+// given several times.
+func parseFlags(arg string, allowed ...string) (map[string][]string, string, error) {
+	flags := map[string][]string{}
+	rest := strings.TrimSpace(arg)
+	for strings.HasPrefix(rest, "--") {
+		word, remainder := rest, ""
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			word, remainder = rest[:i], rest[i:]
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(word, "--"), "=")
+		if !ok || value == "" {
+			return nil, "", fmt.Errorf("invalid flag %s: expected --name=value", word)
+		}
+		if !slices.Contains(allowed, name) {
+			return nil, "", fmt.Errorf("unknown flag: --%s", name)
+		}
+		flags[name] = append(flags[name], value)
+		rest = strings.TrimSpace(remainder)
+	}
+	return flags, rest, nil
+}
+
+// parseKeyValues parses instruction arguments of the form
+// key=value key2="value with spaces". Double quotes group words and
+// are removed; a backslash escapes the next character.
+func parseKeyValues(arg string) ([][2]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, inQuotes, escaped := false, false, false
+
+	for _, r := range arg {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == '"':
+			inQuotes, inWord = !inQuotes, true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %s", arg)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	pairs := make([][2]string, 0, len(words))
+	for _, w := range words {
+		key, value, ok := strings.Cut(w, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %s", w)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
@@ -2,15 +2,18 @@ package build
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 
+	"github.com/lariskovski/containy/internal/archive"
 	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/container"
+	"github.com/lariskovski/containy/internal/download"
+	"github.com/lariskovski/containy/internal/overlay"
 )
 
 // checkIfLayerExists determines if a layer with the given ID already exists on disk.
@@ -31,12 +34,70 @@ func checkIfLayerExists(id string) bool {
 	return true // Directory exists
 }
 
+// fileExists reports whether a file or directory exists at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// fileDigest returns the "sha256:<hex>" digest of a file's content.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractArchive extracts a tar archive, optionally compressed, into
+// dest. Entries with absolute names or names leaving dest, directly or
+// through symbolic links extracted before them, are rejected.
+func extractArchive(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer r.Close()
+	return archive.Extract(r, dest)
+}
+
+// isTarArchive reports whether the file at path is a tar archive,
+// uncompressed or compressed with any supported format.
+func isTarArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false, err
+	}
+
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return false, nil
+	}
+	defer r.Close()
+	_, err = tar.NewReader(r).Next()
+	return err == nil, nil
+}
+
 // buildLowerDir constructs the lowerdir path for overlayfs mounting.
 //
-// The lowerdir for a RUN instruction depends on the previous instruction:
-//   - After FROM: Uses the lower directory of the base image
-//   - After other instructions: Chains the current layer's upper directory
-//     with previous lower directories
+// The lowerdir of a new layer stacks the content of every layer of the
+// current stage, with the most recent layer on top (first).
 //
 // Parameters:
 //   - state: The current build state containing layer information
@@ -44,12 +105,11 @@ func checkIfLayerExists(id string) bool {
 // Returns:
 //   - string: The formatted lowerdir path for overlayfs mount
 func buildLowerDir(state *BuildState) string {
-	var latestLayer = state.CurrentLayer
-	if state.CurrentInstructionType == "FROM" {
-		return latestLayer.GetLowerDir()
+	ids := make([]string, 0, len(state.Layers))
+	for _, layer := range state.Layers {
+		ids = append(ids, layer.GetID())
 	}
-	return latestLayer.GetLowerDir() + ":" + latestLayer.GetUpperDir()
-
+	return overlay.LowerDirs(ids)
 }
 
 // prepareCommandArgs constructs the argument slice for container execution.
@@ -69,11 +129,31 @@ func prepareCommandArgs(mergedDir, arg string) []string {
 	return append([]string{mergedDir}, args...)
 }
 
+// runOptions returns the container options for a RUN instruction: the
+// build's run options combined with the environment, working directory
+// and user recorded in the image configuration so far.
+func runOptions(state *BuildState) container.Options {
+	opts := state.Options.RunOptions
+	opts.Env = append(append([]string{}, state.Config.Env...), opts.Env...)
+	if opts.WorkingDir == "" {
+		opts.WorkingDir = state.Config.WorkingDir
+	}
+	if opts.User == "" {
+		opts.User = state.Config.User
+	}
+	return opts
+}
+
 // DownloadRootFS downloads the Alpine root filesystem from the given URL and extracts it to the specified destination directory.
 // download alpine root fs  https://dl-cdn.alpinelinux.org/alpine/v3.21/releases/x86_64/alpine-minirootfs-3.21.3-x86_64.tar.gz
-func DownloadRootFS(url string, dest string) error {
+//
+// The archive may be uncompressed or gzip, bzip2, xz or zstd compressed; the
+// format is detected from its content. It is decompressed and extracted as
+// it is downloaded, and kept in the download cache for later builds. If
+// checksum is not empty, the download is verified against it and the
+// extraction is rejected on a mismatch.
+func DownloadRootFS(url string, dest string, checksum string) error {
 	config.Log.Debugf("Downloading root filesystem from %s to %s", url, dest)
-	outputTarName := filepath.Join(dest, "alpine-minirootfs.tar.gz")
 	// Check if the destination directory exists
 	if _, err := os.Stat(dest); err != nil {
 		if !os.IsNotExist(err) {
@@ -98,133 +178,51 @@ func DownloadRootFS(url string, dest string) error {
 		config.Log.Errorf("Failed to create directory %s: %v", dest, err)
 		return fmt.Errorf("failed to create directory %s: %v", dest, err)
 	}
-	// Download the root filesystem tarball
-	if err := downloadFile(url, outputTarName); err != nil {
+
+	// Stream the download, from the download cache if it was fetched before
+	body, err := download.Open(url, checksum)
+	if err != nil {
 		config.Log.Errorf("Failed to download root filesystem: %v", err)
 		return fmt.Errorf("failed to download root filesystem: %v", err)
 	}
-	// Check if the downloaded file is a valid tarball
-	file, err := os.Open(outputTarName)
+	defer body.Close()
+
+	r, err := archive.Decompress(body)
 	if err != nil {
-		config.Log.Errorf("Failed to open downloaded file: %v", err)
-		return fmt.Errorf("failed to open downloaded file: %v", err)
+		return fmt.Errorf("failed to read root filesystem archive: %w", err)
 	}
-	defer file.Close()
-	// Extract the tarball
-	if err := extractTarGz(outputTarName, dest); err != nil {
+	defer r.Close()
+
+	// Extract the tarball, confining every entry to the destination directory
+	if err := archive.Extract(r, dest); err != nil {
 		config.Log.Errorf("Failed to extract root filesystem: %v", err)
 		return fmt.Errorf("failed to extract root filesystem: %v", err)
 	}
-	// Remove the tarball after extraction
-	if err := os.Remove(outputTarName); err != nil {
-		config.Log.Errorf("Failed to remove tarball: %v", err)
-		return fmt.Errorf("failed to remove tarball: %v", err)
+	// Read what follows the end of the archive, so that the whole download
+	// is verified against the checksum and cached
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("failed to download root filesystem: %w", err)
 	}
 	return nil
 }
 
-func downloadFile(url, dest string) error {
-	config.Log.Debugf("Downloading file from %s to %s", url, dest)
-	// Create the file
-	out, err := os.Create(dest)
-	if err != nil {
-		config.Log.Errorf("Failed to create file %s: %v", dest, err)
-		return fmt.Errorf("failed to create file %s: %v", dest, err)
-	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		config.Log.Errorf("Failed to get data from %s: %v", url, err)
-		return fmt.Errorf("failed to get data from %s: %v", url, err)
+// parseChecksum validates the value of a --checksum flag, which must be a
+// SHA-256 digest of the form "sha256:<hex>". It returns "" if the flag
+// is not set.
+func parseChecksum(values []string) (string, error) {
+	if len(values) == 0 {
+		return "", nil
 	}
-	defer resp.Body.Close()
-
-	// Check for HTTP errors
-	if resp.StatusCode != http.StatusOK {
-		config.Log.Errorf("Failed to download file: %s", resp.Status)
-		return fmt.Errorf("failed to download file: %s", resp.Status)
+	if len(values) > 1 {
+		return "", fmt.Errorf("--checksum given more than once")
 	}
 
-	// Write the body to file
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		config.Log.Errorf("Failed to write data to file %s: %v", dest, err)
-		return fmt.Errorf("failed to write data to file %s: %v", dest, err)
+	algorithm, sum, ok := strings.Cut(values[0], ":")
+	if !ok || algorithm != "sha256" {
+		return "", fmt.Errorf("invalid checksum %q: expected sha256:<hex>", values[0])
 	}
-	return nil
-}
-
-func extractTarGz(gzipPath, dest string) error {
-	config.Log.Debugf("Extracting tar.gz file %s to %s", gzipPath, dest)
-	// Open the .tar.gz file
-	file, err := os.Open(gzipPath)
-	if err != nil {
-		config.Log.Errorf("Failed to open tar.gz file %s: %v", gzipPath, err)
-		return fmt.Errorf("failed to open tar.gz file %s: %v", gzipPath, err)
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum %q: expected 64 hexadecimal digits", values[0])
 	}
-	defer file.Close()
-
-	// Create a gzip reader
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		config.Log.Errorf("Failed to create gzip reader for file %s: %v", gzipPath, err)
-		return fmt.Errorf("failed to create gzip reader for file %s: %v", gzipPath, err)
-	}
-	defer gzr.Close()
-
-	// Create a tar reader
-	tr := tar.NewReader(gzr)
-
-	// Iterate through the files in the archive
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
-		if err != nil {
-			config.Log.Errorf("Failed to read tar header: %v", err)
-			return fmt.Errorf("failed to read tar header: %v", err)
-		}
-
-		target := filepath.Join(dest, header.Name)
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// Create directory
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				config.Log.Errorf("Failed to create directory %s: %v", target, err)
-				return fmt.Errorf("failed to create directory %s: %v", target, err)
-			}
-		case tar.TypeReg:
-			// Create containing directory if necessary
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				config.Log.Errorf("Failed to create directory %s: %v", filepath.Dir(target), err)
-				return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(target), err)
-			}
-			// Create file
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
-				config.Log.Errorf("Failed to create file %s: %v", target, err)
-				return fmt.Errorf("failed to create file %s: %v", target, err)
-			}
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				config.Log.Errorf("Failed to write to file %s: %v", target, err)
-				return fmt.Errorf("failed to write to file %s: %v", target, err)
-			}
-			outFile.Close()
-		case tar.TypeSymlink:
-			// Create symbolic link
-			if err := os.Symlink(header.Linkname, target); err != nil {
-				config.Log.Errorf("Failed to create symlink %s -> %s: %v", target, header.Linkname, err)
-				return fmt.Errorf("failed to create symlink %s -> %s: %v", target, header.Linkname, err)
-			}
-		default:
-			// Skip other file types
-			config.Log.Warnf("Skipping unknown type: %v in %s", header.Typeflag, header.Name)
-		}
-	}
-
-	return nil
+	return "sha256:" + strings.ToLower(sum), nil
 }
@@ -1,9 +1,18 @@
 package config
 
 const (
-	// !!! Base and Alias directories need trailing slashes
-	BaseOverlayDir = "tmp/build/layers/"
-	AliasDir       = "tmp/build/alias/"
-	IDLength       = 10
-	DefaultPATH    = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// !!! Base and Image directories need trailing slashes
+	BaseOverlayDir  = "tmp/build/layers/"
+	ImageDir        = "tmp/build/images/"
+	ContainerDir    = "tmp/containers/"
+	VolumeDir       = "tmp/volumes/"
+	DownloadDir     = "tmp/cache/downloads/"
+	CacheMountDir   = "tmp/cache/mounts/"
+	IDLength        = 10
+	DefaultHostname = "container"
+	DefaultPATH     = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// RegistryAuthFile holds registry credentials in the format of Docker's
+	// config.json; the REGISTRY_AUTH_FILE environment variable overrides it
+	RegistryAuthFile = "tmp/auth.json"
 )
@@ -1,13 +1,20 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/overlay"
+	"github.com/lariskovski/containy/internal/user"
+	"golang.org/x/sys/unix"
 )
 
 // containerNamespaceFlags defines the Linux namespaces to isolate for containers.
@@ -15,49 +22,363 @@ import (
 // - CLONE_NEWUTS: Hostname and domain name
 // - CLONE_NEWNS: Mount points
 // - CLONE_NEWPID: Process IDs
-const containerNamespaceFlags = syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+// - CLONE_NEWIPC: System V IPC objects and POSIX message queues
+// - CLONE_NEWCGROUP: The view of the cgroup hierarchy
+// - CLONE_NEWTIME: Monotonic and boot-time clocks
+//
+// UTS, PID and IPC isolation can be relaxed with the --uts, --pid and --ipc options.
+const containerNamespaceFlags = syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+	syscall.CLONE_NEWIPC | syscall.CLONE_NEWCGROUP | unix.CLONE_NEWTIME
+
+// specEnv is the environment variable used to hand the resolved container
+// spec from the parent process to the re-executed child.
+const specEnv = "_CONTAINY_SPEC"
+
+// Options holds the user supplied settings for `containy run`.
+type Options struct {
+	// Volumes are bind mount specs of the form source:target[:ro|rw]
+	Volumes []string
+
+	// Tmpfs are tmpfs mount specs of the form target[:options]
+	Tmpfs []string
+
+	// ReadOnly mounts the container's root filesystem read-only
+	ReadOnly bool
+
+	// Remove deletes the container record and its anonymous volumes on exit
+	Remove bool
+
+	// Interactive keeps the container's stdin attached to the host's stdin
+	Interactive bool
+
+	// TTY allocates a pseudo-terminal for the container
+	TTY bool
+
+	// IPC, PID and UTS select the namespace mode: empty for a new namespace,
+	// "host" to share the host's, or "container:<id>" to join another container's
+	IPC string
+	PID string
+	UTS string
 
-// Create initializes and runs a new container.
-// This function is the main entry point for container creation and execution.
-// It handles both the parent and child processes in a fork/exec pattern.
+	// Hostname and Domainname set the container's host and NIS domain name
+	Hostname   string
+	Domainname string
+
+	// DNS and DNSSearch override the nameservers and search domains taken
+	// from the host's resolv.conf
+	DNS       []string
+	DNSSearch []string
+
+	// ExtraHosts are additional /etc/hosts entries of the form host:ip
+	ExtraHosts []string
+
+	// Network selects the network of commands run by Create: empty or
+	// "host" to share the host's network, "none" for a network namespace
+	// of their own with only a loopback interface
+	Network string
+
+	// Env are KEY=VALUE environment variables; a bare KEY is taken from the host
+	Env []string
+
+	// EnvFiles are files with one KEY=VALUE variable per line
+	EnvFiles []string
+
+	// WorkingDir is the working directory of the command inside the container
+	WorkingDir string
+
+	// User is the user[:group] the command runs as, by name or numeric ID
+	User string
+
+	// Mounts are additional mounts prepared by the caller, such as the
+	// cache mounts of RUN --mount; they are only used by Create
+	Mounts []Mount
+}
+
+// spec is the fully resolved configuration of a container. It is built by
+// the parent process and passed to the child, which applies it after
+// namespace isolation.
+type spec struct {
+	// Rootfs is the overlay filesystem's merged directory
+	Rootfs string `json:"rootfs"`
+
+	// Overlay is mounted at Rootfs by the child before anything else,
+	// when the rootfs is not already mounted by the parent
+	Overlay *overlay.OverlayFS `json:"overlay,omitempty"`
+
+	// Args is the command and its arguments
+	Args []string `json:"args"`
+
+	// Shell runs Args as a command line with /bin/sh -c; otherwise Args[0]
+	// is executed directly, as for an image's entrypoint
+	Shell bool `json:"shell,omitempty"`
+
+	// Mounts are bind and tmpfs mounts applied before pivot_root
+	Mounts []Mount `json:"mounts,omitempty"`
+
+	// ReadOnly remounts the root filesystem read-only after pivot_root
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Interactive attaches the host's stdin to the container
+	Interactive bool `json:"interactive,omitempty"`
+
+	// Terminal runs the container on a newly allocated pty
+	Terminal bool `json:"terminal,omitempty"`
+
+	// CloneFlags are the namespaces newly created for the container
+	CloneFlags uintptr `json:"cloneFlags"`
+
+	// JoinNamespaces are the namespace files (/proc/<pid>/ns/*) of other
+	// containers that the container joins instead of creating its own
+	JoinNamespaces []string `json:"joinNamespaces,omitempty"`
+
+	// Hostname and Domainname are set when the container has its own UTS namespace
+	Hostname   string `json:"hostname,omitempty"`
+	Domainname string `json:"domainname,omitempty"`
+
+	// Env is the complete environment of the command
+	Env []string `json:"env"`
+
+	// WorkingDir is the working directory of the command
+	WorkingDir string `json:"workingDir,omitempty"`
+
+	// User is the user[:group] to run the command as, resolved inside the container
+	User string `json:"user,omitempty"`
+}
+
+// Run starts a container from an image, as requested by `containy run`.
+// Unlike Create, it records the container under config.ContainerDir,
+// gives it a writable layer on top of the image's layers and sets up the
+// image's volumes.
 //
-// The function detects whether it's running in the parent or child process:
-// - In the parent: It spawns a child process with namespace isolation
-// - In the child: It sets up the containerized environment and runs the command
+// When invoked in the re-executed child process, it sets up the
+// containerized environment from the spec handed over by the parent.
+//
+// Parameters:
+//   - args: A slice where args[0] is the image name or ID and the
+//     remaining elements are the command and its arguments
+//   - opts: The user supplied run options
+func Run(args []string, opts Options) error {
+	// /proc/self/exe is the current executable this is used to re-execute
+	// the current binary in the child process This is a common pattern in
+	// container runtimes to re-execute the current binary with new namespaces
+	if os.Args[0] == "/proc/self/exe" {
+		s, err := loadSpec()
+		if err != nil {
+			return err
+		}
+		return handleChildProcess(s)
+	}
+
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient arguments: expected at least an image")
+	}
+
+	imageName := args[0]
+	img, err := image.Resolve(imageName)
+	if err != nil {
+		return err
+	}
+	imageConfig := &img.Config
+
+	command, shell, err := resolveCommand(imageConfig, args[1:])
+	if err != nil {
+		return err
+	}
+
+	cloneFlags, joins, err := resolveNamespaces(opts)
+	if err != nil {
+		return err
+	}
+	if cloneFlags&syscall.CLONE_NEWUTS == 0 && (opts.Hostname != "" || opts.Domainname != "") {
+		return fmt.Errorf("--hostname and --domainname cannot be used with --uts")
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	// The container gets its own writable layer on top of the image's layers
+	containerDir := filepath.Join(config.ContainerDir, id)
+	rootfsOverlay := &overlay.OverlayFS{
+		ID:        id,
+		LowerDir:  overlay.LowerDirs(img.Layers),
+		UpperDir:  filepath.Join(containerDir, "upper"),
+		WorkDir:   filepath.Join(containerDir, "work"),
+		MergedDir: filepath.Join(containerDir, "rootfs"),
+	}
+	for _, dir := range []string{rootfsOverlay.UpperDir, rootfsOverlay.WorkDir, rootfsOverlay.MergedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create container directory: %w", err)
+		}
+	}
+
+	state := &State{ID: id, Image: imageName, ImageID: img.ID, Command: command, Created: time.Now()}
+	mounts, anonymous, err := resolveMounts(opts, imageConfig.Volumes)
+	state.AnonymousVolumes = anonymous
+	if saveErr := state.save(); saveErr != nil {
+		return saveErr
+	}
+	if err != nil {
+		return err
+	}
+
+	hostname, err := resolveHostname(opts, cloneFlags)
+	if err != nil {
+		return err
+	}
+	etc, err := etcMounts(containerDir, hostname, opts, mounts)
+	if err != nil {
+		return err
+	}
+
+	env, err := buildEnv(hostname, imageConfig.Env, opts)
+	if err != nil {
+		return err
+	}
+	workingDir := opts.WorkingDir
+	if workingDir == "" {
+		workingDir = imageConfig.WorkingDir
+	}
+	userSpec := opts.User
+	if userSpec == "" {
+		userSpec = imageConfig.User
+	}
+	config.Log.Infof("Starting container %s", id)
+
+	runErr := spawnChildProcess(&spec{
+		Rootfs:         rootfsOverlay.MergedDir,
+		Overlay:        rootfsOverlay,
+		Args:           command,
+		Shell:          shell,
+		Mounts:         append(mounts, etc...),
+		ReadOnly:       opts.ReadOnly || imageConfig.ReadOnly(),
+		Interactive:    opts.Interactive,
+		Terminal:       opts.TTY,
+		CloneFlags:     cloneFlags,
+		JoinNamespaces: joins,
+		Hostname:       hostname,
+		Domainname:     opts.Domainname,
+		Env:            env,
+		WorkingDir:     workingDir,
+		User:           userSpec,
+	}, state)
+
+	if opts.Remove {
+		if err := Remove(id, true); err != nil {
+			config.Log.Errorf("Failed to remove container %s: %v", id, err)
+		}
+	}
+	return runErr
+}
+
+// Create runs a command in an overlay directory without recording a
+// container. It is used by the build process to execute RUN instructions.
+// The container's /etc/hostname, /etc/hosts and /etc/resolv.conf are
+// generated in a temporary directory and never become part of the layer;
+// the mount points created for them when the rootfs lacks the files are
+// removed once the command exits.
 //
 // Parameters:
 //   - args: A slice where args[0] is the overlay directory path and
 //     the remaining elements are the command and its arguments
-//
-// The function will terminate the process if errors are encountered.
-func Create(args []string) error {
+//   - opts: The run options; the DNS, host, network, environment,
+//     working directory, user and mount settings are used
+func Create(args []string, opts Options) error {
 	if len(args) < 2 {
 		return fmt.Errorf("insufficient arguments: expected at least overlay directory and command")
 	}
 
-	overlayDir := args[0]
-	commandArgs := args[1:]
+	netFlags, err := networkFlags(opts.Network)
+	if err != nil {
+		return err
+	}
 
-	// Check if the overlay directory is an alias
-	// If it is, resolve the alias to the actual directory
-	alias, err := os.Readlink(config.AliasDir + overlayDir)
-	if err == nil  {
-		overlayDir = alias
+	rootfs, err := resolveRootfs(args[0])
+	if err != nil {
+		return err
+	}
+
+	etcDir, err := os.MkdirTemp("", "containy-etc-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
 	}
+	defer os.RemoveAll(etcDir)
+
+	etc, err := etcMounts(etcDir, config.DefaultHostname, opts, opts.Mounts)
+	if err != nil {
+		return err
+	}
+
+	env, err := buildEnv(config.DefaultHostname, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	mountpoints := MissingMountpoints(rootfs, etc)
+	defer RemoveMountpoints(rootfs, mountpoints)
+
+	return spawnChildProcess(&spec{
+		Rootfs:     rootfs,
+		Args:       args[1:],
+		Shell:      true,
+		Mounts:     append(append([]Mount{}, opts.Mounts...), etc...),
+		CloneFlags: containerNamespaceFlags | netFlags,
+		Hostname:   config.DefaultHostname,
+		Env:        env,
+		WorkingDir: opts.WorkingDir,
+		User:       opts.User,
+	}, nil)
+}
+
+// resolveCommand determines the command of a container from the command
+// line and the image's entrypoint and default command. A command given on
+// the command line replaces the image's default command; with an
+// entrypoint it becomes the entrypoint's arguments.
+//
+// Returns:
+//   - []string: The command and its arguments
+//   - bool: Whether the command is a command line to run with /bin/sh -c,
+//     which is the case for commands given without an image entrypoint
+//   - error: No command was given and the image has none
+func resolveCommand(c *image.Config, args []string) ([]string, bool, error) {
+	if len(c.Entrypoint) > 0 {
+		if len(args) == 0 {
+			args = c.Cmd
+		}
+		return append(append([]string{}, c.Entrypoint...), args...), false, nil
+	}
+	if len(args) > 0 {
+		return args, true, nil
+	}
+	if len(c.Cmd) > 0 {
+		return c.Cmd, false, nil
+	}
+	return nil, false, fmt.Errorf("no command specified and the image has no default command")
+}
 
+// resolveRootfs checks that an overlay directory path exists.
+func resolveRootfs(overlayDir string) (string, error) {
 	// Check if the overlay directory exists
 	if _, err := os.Stat(overlayDir); os.IsNotExist(err) {
-		return fmt.Errorf("overlay directory does not exist: %s", overlayDir)
+		return "", fmt.Errorf("overlay directory does not exist: %s", overlayDir)
 	}
+	return overlayDir, nil
+}
 
-	// /proc/self/exe is the current executable this is used to re-execute
-	// the current binary in the child process This is a common pattern in
-	// container runtimes to re-execute the current binary with new namespaces
-	if os.Args[0] == "/proc/self/exe" {
-		return handleChildProcess(overlayDir, commandArgs)
+// loadSpec reads the container spec handed over by the parent process.
+func loadSpec() (*spec, error) {
+	data := os.Getenv(specEnv)
+	if data == "" {
+		return nil, fmt.Errorf("missing container spec in child process")
 	}
+	os.Unsetenv(specEnv)
 
-	return spawnChildProcess(overlayDir, commandArgs)
+	s := &spec{}
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		return nil, fmt.Errorf("failed to decode container spec: %w", err)
+	}
+	return s, nil
 }
 
 // spawnChildProcess creates a new isolated process for the container.
@@ -65,15 +386,42 @@ func Create(args []string) error {
 // then re-executes the current binary to set up the container.
 //
 // Parameters:
-//   - overlayDir: Path to the overlay filesystem's merged directory
-//   - commandArgs: The command and arguments to run inside the container
-func spawnChildProcess(overlayDir string, commandArgs []string) error {
+//   - s: The resolved container spec
+//   - state: The container record to update with the process ID, or nil
+func spawnChildProcess(s *spec, state *State) error {
 	config.Log.Debugf("Spawning child with new namespaces")
-	cmd, err := execCommand(overlayDir, commandArgs, true)
+	cmd, err := execCommand(s, true)
 	if err != nil {
 		return fmt.Errorf("error creating command: %w", err)
 	}
-	if err := cmd.Run(); err != nil {
+
+	start := func() error {
+		if err := startInNamespaces(cmd, s.JoinNamespaces); err != nil {
+			return err
+		}
+		// Record the PID so that other containers can join our namespaces
+		if state != nil {
+			state.Pid = cmd.Process.Pid
+			if err := state.save(); err != nil {
+				config.Log.Warnf("Failed to record container PID: %v", err)
+			}
+		}
+		return nil
+	}
+
+	if s.Terminal {
+		err = runWithTerminal(cmd, s.Interactive, start)
+	} else if err = start(); err == nil {
+		err = cmd.Wait()
+	}
+
+	if state != nil && state.Pid != 0 {
+		state.Pid = 0
+		if err := state.save(); err != nil {
+			config.Log.Warnf("Failed to update container state: %v", err)
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("error running command: %w", err)
 	}
 	config.Log.Debugf("Child process finished")
@@ -85,25 +433,30 @@ func spawnChildProcess(overlayDir string, commandArgs []string) error {
 // after namespace isolation.
 //
 // It performs the following container setup:
-// 1. Sets up namespaces (hostname, mount, etc.)
-// 2. Configures the filesystem view via pivot_root
-// 3. Mounts /proc and sets up the PATH environment
-// 4. Executes the specified command
+// 1. Sets up namespaces (hostname, mount, etc.) and mounts the rootfs overlay
+// 2. Mounts volumes and tmpfs filesystems into the rootfs
+// 3. Configures the filesystem view via pivot_root
+// 4. Creates the working directory and remounts the root read-only if requested
+// 5. Mounts /proc and sets up the PATH environment
+// 6. Resolves the user of the command
+// 7. Executes the specified command
 //
 // Parameters:
-//   - overlayDir: Path to the overlay filesystem's merged directory
-//   - commandArgs: The command and arguments to run inside the container
-func handleChildProcess(overlayDir string, commandArgs []string) error {
+//   - s: The container spec handed over by the parent process
+func handleChildProcess(s *spec) error {
 	config.Log.Debugf("In child process")
 
-	if err := setupNamespaces(overlayDir); err != nil {
+	if err := setupNamespaces(s); err != nil {
 		return fmt.Errorf("error setting up namespaces: %w", err)
 	}
 
-	cmd, err := execCommand(overlayDir, commandArgs, false)
+	cmd, err := execCommand(s, false)
 	if err != nil {
 		return fmt.Errorf("error creating command: %w", err)
 	}
+	if err := setupProcess(cmd, s); err != nil {
+		return err
+	}
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error running command: %w", err)
@@ -124,33 +477,74 @@ func handleChildProcess(overlayDir string, commandArgs []string) error {
 //     already-prepared container environment
 //
 // Parameters:
-//   - overlayDir: Path to the overlay filesystem's merged directory
-//   - commandArgs: The command and arguments to run
+//   - s: The container spec with the rootfs and command to run
 //   - spawnChild: Whether to create a child process with namespace isolation
 //
 // Returns:
 //   - *exec.Cmd: The prepared command ready for execution
 //   - error: Any error encountered during command creation
-func execCommand(overlayDir string, commandArgs []string, spawnChild bool) (*exec.Cmd, error) {
-	config.Log.Debugf("Running command: %v", commandArgs)
+func execCommand(s *spec, spawnChild bool) (*exec.Cmd, error) {
+	config.Log.Debugf("Running command: %v", s.Args)
 
 	var cmd *exec.Cmd
 
 	if spawnChild {
-		cmd = exec.Command("/proc/self/exe", append([]string{"run", overlayDir}, commandArgs...)...)
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode container spec: %w", err)
+		}
+		cmd = exec.Command("/proc/self/exe", append([]string{"run", s.Rootfs}, s.Args...)...)
+		cmd.Env = append(os.Environ(), specEnv+"="+string(data))
 		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags:   containerNamespaceFlags,
+			Cloneflags:   s.CloneFlags,
 			Unshareflags: syscall.CLONE_NEWNS,
 		}
+	} else if s.Shell {
+		cmd = exec.Command("/bin/sh", "-c", strings.Join(s.Args, " "))
 	} else {
-		cmd = exec.Command("/bin/sh", "-c", strings.Join(commandArgs, " "))
+		cmd = exec.Command(s.Args[0], s.Args[1:]...)
+	}
+	// Without -i the container reads from /dev/null; inside the container
+	// the child's stdin has already been set up by the parent
+	if !spawnChild || s.Interactive {
+		cmd.Stdin = os.Stdin
 	}
-	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd, nil
 }
 
+// setupProcess applies the spec's environment, user and working
+// directory to the container command. It runs after pivot_root, so the
+// user is resolved against the container's /etc/passwd and /etc/group.
+func setupProcess(cmd *exec.Cmd, s *spec) error {
+	userSpec := s.User
+	if userSpec == "" {
+		userSpec = "0"
+	}
+	u, err := user.Lookup("/", userSpec)
+	if err != nil {
+		return err
+	}
+
+	cmd.Env = s.Env
+	if _, ok := lookupEnv(cmd.Env, "HOME"); !ok {
+		cmd.Env = append(cmd.Env, "HOME="+u.Home)
+	}
+
+	if s.User != "" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: u.Uid, Gid: u.Gid, Groups: u.Groups},
+		}
+	}
+
+	// The working directory was created by setupNamespaces
+	if s.WorkingDir != "" {
+		cmd.Dir = s.WorkingDir
+	}
+	return nil
+}
+
 // logError formats and logs an error message.
 // It provides context about where the error occurred and returns the original
 // error for further handling.
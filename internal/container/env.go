@@ -0,0 +1,131 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// buildEnv assembles the container's environment from scratch, so that
+// nothing from the host environment leaks into the container except what
+// is explicitly requested. Later sources override earlier ones:
+//  1. Defaults (PATH, HOSTNAME and TERM when a terminal is allocated)
+//  2. The image's configured environment
+//  3. Variables read from --env-file files
+//  4. Variables given with -e
+//
+// Parameters:
+//   - hostname: The container's hostname, or "" if it is not known
+//   - imageEnv: The environment recorded in the image configuration
+//   - opts: The run options with the -e, --env-file and -t settings
+//
+// Returns:
+//   - []string: The environment as KEY=VALUE pairs
+//   - error: An unreadable env file or invalid variable
+func buildEnv(hostname string, imageEnv []string, opts Options) ([]string, error) {
+	env := []string{config.DefaultPATH}
+	if hostname != "" {
+		env = append(env, "HOSTNAME="+hostname)
+	}
+	if opts.TTY {
+		env = append(env, "TERM=xterm")
+	}
+	env = mergeEnv(env, imageEnv)
+
+	for _, path := range opts.EnvFiles {
+		vars, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = mergeEnv(env, vars)
+	}
+
+	vars, err := expandEnvArgs(opts.Env)
+	if err != nil {
+		return nil, err
+	}
+	return mergeEnv(env, vars), nil
+}
+
+// mergeEnv returns env with the variables in overrides set, replacing
+// existing values with the same key.
+func mergeEnv(env, overrides []string) []string {
+	merged := append([]string{}, env...)
+	for _, kv := range overrides {
+		key, _, _ := strings.Cut(kv, "=")
+		replaced := false
+		for i, existing := range merged {
+			if k, _, _ := strings.Cut(existing, "="); k == key {
+				merged[i] = kv
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+// lookupEnv returns the value of key in env.
+func lookupEnv(env []string, key string) (string, bool) {
+	for _, kv := range env {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// expandEnvArgs validates KEY=VALUE arguments. A bare KEY takes its value
+// from the host environment, and is dropped if the host does not set it.
+func expandEnvArgs(args []string) ([]string, error) {
+	var vars []string
+	for _, arg := range args {
+		key, _, hasValue := strings.Cut(arg, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid environment variable %q", arg)
+		}
+		if hasValue {
+			vars = append(vars, arg)
+			continue
+		}
+		if value, ok := os.LookupEnv(key); ok {
+			vars = append(vars, key+"="+value)
+		}
+	}
+	return vars, nil
+}
+
+// readEnvFile reads KEY=VALUE lines from an env file. Empty lines and
+// lines starting with '#' are skipped.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open env file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+
+	vars, err := expandEnvArgs(lines)
+	if err != nil {
+		return nil, fmt.Errorf("env file %s: %w", path, err)
+	}
+	return vars, nil
+}
@@ -0,0 +1,205 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// hostResolvConf is the resolver configuration the container's
+// /etc/resolv.conf is derived from.
+const hostResolvConf = "/etc/resolv.conf"
+
+// defaultNameservers are used when neither --dns nor the host's
+// resolv.conf provide a nameserver.
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// etcMounts generates the container's /etc/hostname, /etc/hosts and
+// /etc/resolv.conf in dir and returns the bind mounts placing them in the
+// rootfs. Files whose target is already mounted explicitly are skipped.
+//
+// Parameters:
+//   - dir: Host directory owning the generated files
+//   - hostname: The container's hostname, or "" if it is not known, in
+//     which case the image's /etc/hostname is kept
+//   - opts: The run options with the DNS and extra host settings
+//   - existing: The mounts already configured for the container
+//
+// Returns:
+//   - []Mount: The bind mounts for the generated files
+//   - error: Any error encountered while generating the files
+func etcMounts(dir, hostname string, opts Options, existing []Mount) ([]Mount, error) {
+	hosts, err := hostsFile(hostname, opts.Domainname, opts.ExtraHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	resolv, err := resolvConf(opts.DNS, opts.DNSSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"hostname", hostname + "\n"},
+		{"hosts", hosts},
+		{"resolv.conf", resolv},
+	}
+
+	explicit := map[string]bool{"/etc/hostname": hostname == ""}
+	for _, m := range existing {
+		explicit[m.Target] = true
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	var mounts []Mount
+	for _, f := range files {
+		target := "/etc/" + f.name
+		if explicit[target] {
+			continue
+		}
+
+		source, err := filepath.Abs(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(source, []byte(f.content), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", source, err)
+		}
+		mounts = append(mounts, Mount{Source: source, Target: target})
+	}
+
+	return mounts, nil
+}
+
+// resolveHostname returns the hostname of a container. A container sharing
+// the UTS namespace of the host or of another container has the hostname
+// of that namespace: the host's, or the one generated for the other
+// container. The latter is not known if the other container mounted its own
+// /etc/hostname, in which case "" is returned.
+//
+// Parameters:
+//   - opts: The run options with the --hostname and --uts settings
+//   - cloneFlags: The namespaces created for the container
+//
+// Returns:
+//   - string: The hostname, or "" if it is not known
+//   - error: Any error encountered while reading the host's name
+func resolveHostname(opts Options, cloneFlags uintptr) (string, error) {
+	switch {
+	case cloneFlags&syscall.CLONE_NEWUTS != 0:
+		if opts.Hostname != "" {
+			return opts.Hostname, nil
+		}
+		return config.DefaultHostname, nil
+	case opts.UTS == "host":
+		name, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the host name: %w", err)
+		}
+		return name, nil
+	default:
+		dir, err := stateDir(strings.TrimPrefix(opts.UTS, "container:"))
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "hostname"))
+		if err != nil {
+			return "", nil
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// hostsFile renders the container's /etc/hosts. Extra hosts are given as
+// "name:ip", as accepted by --add-host.
+func hostsFile(hostname, domainname string, extraHosts []string) (string, error) {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+
+	names := hostname
+	if domainname != "" {
+		names = hostname + "." + domainname + " " + hostname
+	}
+	if names != "" {
+		fmt.Fprintf(&b, "127.0.1.1\t%s\n", names)
+	}
+
+	for _, entry := range extraHosts {
+		name, ip, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid --add-host %q: expected host:ip", entry)
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ip, name)
+	}
+
+	return b.String(), nil
+}
+
+// resolvConf renders the container's /etc/resolv.conf from the host's,
+// replacing its nameservers and search domains when dns or search are set.
+func resolvConf(dns, search []string) (string, error) {
+	for _, ns := range dns {
+		if net.ParseIP(ns) == nil {
+			return "", fmt.Errorf("invalid --dns %q: not an IP address", ns)
+		}
+	}
+
+	var hostNameservers, hostSearch, other []string
+	if f, err := os.Open(hostResolvConf); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				if len(fields) > 1 {
+					hostNameservers = append(hostNameservers, fields[1])
+				}
+			case "search", "domain":
+				hostSearch = append(hostSearch, fields[1:]...)
+			default:
+				other = append(other, scanner.Text())
+			}
+		}
+	} else {
+		config.Log.Debugf("Could not read %s: %v", hostResolvConf, err)
+	}
+
+	if len(dns) == 0 {
+		dns = hostNameservers
+	}
+	if len(dns) == 0 {
+		dns = defaultNameservers
+	}
+	if len(search) == 0 {
+		search = hostSearch
+	}
+
+	var b strings.Builder
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	for _, ns := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	for _, line := range other {
+		b.WriteString(line + "\n")
+	}
+	return b.String(), nil
+}
@@ -1,18 +1,169 @@
 package container
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
+	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/lariskovski/containy/internal/config"
+	"golang.org/x/sys/unix"
 )
 
+// sharableNamespaces maps the namespace options of `containy run` to their
+// clone flag and the file name under /proc/<pid>/ns.
+var sharableNamespaces = []struct {
+	name string
+	flag uintptr
+	file string
+}{
+	{"ipc", syscall.CLONE_NEWIPC, "ipc"},
+	{"pid", syscall.CLONE_NEWPID, "pid"},
+	{"uts", syscall.CLONE_NEWUTS, "uts"},
+}
+
+// resolveNamespaces computes the namespaces to create and to join from the
+// --ipc, --pid and --uts options. Each option is either empty (a new
+// namespace), "host" (no isolation) or "container:<id>" (join the namespace
+// of a running container).
+//
+// Returns:
+//   - uintptr: The clone flags for the namespaces to create
+//   - []string: The namespace files to join
+//   - error: An invalid option or a container that is not running
+func resolveNamespaces(opts Options) (uintptr, []string, error) {
+	flags := uintptr(containerNamespaceFlags)
+	var joins []string
+
+	modes := map[string]string{"ipc": opts.IPC, "pid": opts.PID, "uts": opts.UTS}
+	for _, ns := range sharableNamespaces {
+		mode := modes[ns.name]
+		switch {
+		case mode == "":
+			continue
+		case mode == "host":
+			flags &^= ns.flag
+		case strings.HasPrefix(mode, "container:"):
+			id := strings.TrimPrefix(mode, "container:")
+			state, err := LoadState(id)
+			if err != nil {
+				return 0, nil, fmt.Errorf("--%s: %w", ns.name, err)
+			}
+			if !state.Running() {
+				return 0, nil, fmt.Errorf("--%s: container %s is not running", ns.name, id)
+			}
+			flags &^= ns.flag
+			joins = append(joins, fmt.Sprintf("/proc/%d/ns/%s", state.Pid, ns.file))
+		default:
+			return 0, nil, fmt.Errorf("invalid --%s mode %q: expected host or container:<id>", ns.name, mode)
+		}
+	}
+
+	return flags, joins, nil
+}
+
+// ValidateNetwork checks a network mode of RUN steps: empty or "host" to
+// share the host's network, or "none" to isolate them from it.
+func ValidateNetwork(mode string) error {
+	_, err := networkFlags(mode)
+	return err
+}
+
+// networkFlags returns the clone flags for a network mode.
+func networkFlags(mode string) (uintptr, error) {
+	switch mode {
+	case "", "host":
+		return 0, nil
+	case "none":
+		return syscall.CLONE_NEWNET, nil
+	default:
+		return 0, fmt.Errorf("invalid network mode %q: expected none or host", mode)
+	}
+}
+
+// setupLoopback brings up the loopback interface of a new network
+// namespace, which starts down, so that services listening on localhost
+// stay reachable.
+func setupLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// startInNamespaces starts cmd inside the given existing namespaces.
+//
+// setns only affects the calling thread (and, for PID namespaces, the
+// children it creates), so the namespaces are entered on a dedicated
+// locked OS thread which then forks the child. The thread is never
+// unlocked, so the runtime discards it instead of reusing it.
+func startInNamespaces(cmd *exec.Cmd, namespaces []string) error {
+	if len(namespaces) == 0 {
+		return cmd.Start()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		for _, path := range namespaces {
+			if err := joinNamespace(path); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+// joinNamespace moves the calling thread into the namespace at path.
+func joinNamespace(path string) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open namespace %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Setns(fd, 0); err != nil {
+		return fmt.Errorf("failed to join namespace %s: %w", path, err)
+	}
+	return nil
+}
+
 // setupNamespaces sets up the necessary namespaces for the container environment
-func setupNamespaces(overlayDir string) error {
-	config.Log.Debugf("Setting up namespaces in overlayDir: %s", overlayDir)
+func setupNamespaces(s *spec) error {
+	config.Log.Debugf("Setting up namespaces in overlayDir: %s", s.Rootfs)
+
+	// Only set the hostname in a UTS namespace of our own, never on the
+	// host or in a namespace shared with another container
+	if s.CloneFlags&syscall.CLONE_NEWUTS != 0 {
+		if err := syscall.Sethostname([]byte(s.Hostname)); err != nil {
+			return logError("setting hostname", err)
+		}
+		if s.Domainname != "" {
+			if err := syscall.Setdomainname([]byte(s.Domainname)); err != nil {
+				return logError("setting domain name", err)
+			}
+		}
+	}
 
-	if err := syscall.Sethostname([]byte("container")); err != nil {
-		return logError("setting hostname", err)
+	if s.CloneFlags&syscall.CLONE_NEWNET != 0 {
+		if err := setupLoopback(); err != nil {
+			return logError("bringing up loopback", err)
+		}
 	}
 
 	// makes the mount namespace private
@@ -23,10 +174,37 @@ func setupNamespaces(overlayDir string) error {
 		return logError("making mount private", err)
 	}
 
-	if err := setupPivotRoot(overlayDir); err != nil {
+	if s.Overlay != nil {
+		if err := s.Overlay.Mount(); err != nil {
+			return logError("mounting rootfs", err)
+		}
+	}
+
+	if err := setupMounts(s.Rootfs, s.Mounts); err != nil {
+		return logError("mounting volumes", err)
+	}
+
+	if err := setupPivotRoot(s.Rootfs); err != nil {
 		return logError("performing pivot_root", err)
 	}
 
+	// The working directory is created before the root may become
+	// read-only, like the mountpoints of volumes
+	if s.WorkingDir != "" {
+		if err := os.MkdirAll(s.WorkingDir, 0755); err != nil {
+			return logError("creating working directory", err)
+		}
+	}
+
+	// Only the root mount itself is made read-only, volumes and tmpfs
+	// mounts below it keep their own flags
+	if s.ReadOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+			return logError("remounting root read-only", err)
+		}
+	}
+
 	// proc filesystem is used for process information
 	// and is required for the container to function properly
 	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
@@ -35,5 +213,9 @@ func setupNamespaces(overlayDir string) error {
 
 	// path is used to find executables
 	// and is required for the container to function properly
-	return os.Setenv("PATH", config.DefaultPATH)
+	path, ok := lookupEnv(s.Env, "PATH")
+	if !ok {
+		path = strings.TrimPrefix(config.DefaultPATH, "PATH=")
+	}
+	return os.Setenv("PATH", path)
 }
@@ -0,0 +1,172 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// State is the on-disk record of a container started with `containy run`.
+// It is kept after the container exits so that its resources (its
+// writable layer and anonymous volumes) can be cleaned up later with
+// `containy rm`.
+type State struct {
+	// ID is the unique identifier of the container
+	ID string `json:"id"`
+
+	// Image is the image name or ID the container was started from
+	Image string `json:"image"`
+
+	// ImageID is the ID of the image the container was started from
+	ImageID string `json:"imageId"`
+
+	// Command is the command executed in the container
+	Command []string `json:"command"`
+
+	// Created is the time the container was started
+	Created time.Time `json:"created"`
+
+	// Pid is the host PID of the container's init process while it runs
+	Pid int `json:"pid,omitempty"`
+
+	// AnonymousVolumes lists the volumes created for the image's VOLUME paths
+	AnonymousVolumes []string `json:"anonymousVolumes,omitempty"`
+}
+
+// save writes the container state to its directory under config.ContainerDir.
+func (s *State) save() error {
+	dir := filepath.Join(config.ContainerDir, s.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode container state: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write container state: %w", err)
+	}
+	return nil
+}
+
+// stateDir returns the directory of the container with the given ID under
+// config.ContainerDir. The ID must have the generated form, so that one
+// given by the user, e.g. "../..", cannot name a directory outside of it.
+func stateDir(id string) (string, error) {
+	if len(id) != config.IDLength || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("no such container: %s", id)
+	}
+	return filepath.Join(config.ContainerDir, id), nil
+}
+
+// LoadState reads the state of the container with the given ID.
+func LoadState(id string) (*State, error) {
+	dir, err := stateDir(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container state: %w", err)
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode container state: %w", err)
+	}
+	return s, nil
+}
+
+// Running reports whether the container's init process is still alive.
+func (s *State) Running() bool {
+	return s.Pid > 0 && syscall.Kill(s.Pid, 0) == nil
+}
+
+// Remove deletes a container record. When removeVolumes is true the
+// container's anonymous volumes are deleted as well; named volumes and
+// host directories are never touched.
+func Remove(id string, removeVolumes bool) error {
+	s, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if s.Running() {
+		return fmt.Errorf("container %s is running", id)
+	}
+
+	if removeVolumes {
+		for _, name := range s.AnonymousVolumes {
+			if err := removeVolume(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir, err := stateDir(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove container %s: %w", id, err)
+	}
+	return nil
+}
+
+// List returns the records of all containers.
+func List() ([]*State, error) {
+	entries, err := os.ReadDir(config.ContainerDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var states []*State
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		s, err := LoadState(e.Name())
+		if err != nil {
+			config.Log.Warnf("Skipping container %s: %v", e.Name(), err)
+			continue
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// CheckImageUnused returns an error if a container was created from the
+// image with the given ID. With force, only running containers block the
+// removal of the image.
+func CheckImageUnused(imageID string, force bool) error {
+	states, err := List()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range states {
+		if s.ImageID != imageID {
+			continue
+		}
+		if s.Running() {
+			return fmt.Errorf("image is being used by running container %s", s.ID)
+		}
+		if !force {
+			return fmt.Errorf("image is being used by stopped container %s, use -f to remove it anyway", s.ID)
+		}
+	}
+	return nil
+}
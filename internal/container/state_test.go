@@ -0,0 +1,46 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+func TestRemoveRejectsInvalidIDs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// A directory next to the containers that looks like a container record
+	victim := filepath.Join(config.ContainerDir, "..", "victim")
+	if err := os.MkdirAll(victim, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(victim, "state.json"), []byte(`{"id":"victim"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"../victim", "..", "", "0123456789/..", "0123456789a", "ABCDEF0123", "/etc"} {
+		if err := Remove(id, true); err == nil {
+			t.Errorf("removed container %q", id)
+		}
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("directory outside the containers was removed: %v", err)
+	}
+
+	id, err := randomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateDir(id); err != nil {
+		t.Errorf("generated ID %s rejected: %v", id, err)
+	}
+}
@@ -0,0 +1,160 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/term"
+	"golang.org/x/sys/unix"
+)
+
+// openPTY allocates a new pseudo-terminal pair.
+//
+// Returns:
+//   - *os.File: The master end, kept by the host to proxy I/O
+//   - *os.File: The slave end, handed to the container as its terminal
+//   - error: Any error encountered while allocating the pair
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+
+	// Unlock the slave and look up its number
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+
+	return master, slave, nil
+}
+
+// makeRaw puts the terminal into raw mode, so that keystrokes (including
+// Ctrl-C and Ctrl-Z) are passed to the container's terminal untouched.
+// It returns the previous state to be restored with restoreTerminal.
+func makeRaw(fd int) (*unix.Termios, error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// restoreTerminal restores a terminal state saved by makeRaw.
+func restoreTerminal(fd int, state *unix.Termios) {
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, state); err != nil {
+		config.Log.Warnf("Failed to restore terminal: %v", err)
+	}
+}
+
+// resizePTY copies the window size of the host terminal to the pty.
+func resizePTY(host, pty *os.File) {
+	ws, err := unix.IoctlGetWinsize(int(host.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	if err := unix.IoctlSetWinsize(int(pty.Fd()), unix.TIOCSWINSZ, ws); err != nil {
+		config.Log.Debugf("Failed to resize pty: %v", err)
+	}
+}
+
+// runWithTerminal runs the container process attached to a new pty.
+//
+// The slave end becomes the controlling terminal of the container
+// (the process starts a new session and acquires it with TIOCSCTTY),
+// while the host terminal is put in raw mode and proxied through the
+// master end. Window size changes (SIGWINCH) are propagated to the pty.
+//
+// Parameters:
+//   - cmd: The prepared container command
+//   - interactive: Whether to forward the host's stdin to the container
+//   - start: Starts cmd once its terminal has been set up
+//
+// Returns:
+//   - error: Any error encountered while running the command
+func runWithTerminal(cmd *exec.Cmd, interactive bool, start func() error) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	// Follow the host terminal's window size
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	resizePTY(os.Stdin, master)
+	go func() {
+		for range winch {
+			resizePTY(os.Stdin, master)
+		}
+	}()
+
+	if interactive && term.IsTerminal(os.Stdin) {
+		state, err := makeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			slave.Close()
+			return fmt.Errorf("failed to set terminal raw mode: %w", err)
+		}
+		defer restoreTerminal(int(os.Stdin.Fd()), state)
+	}
+
+	if err := start(); err != nil {
+		slave.Close()
+		return err
+	}
+	// The container holds its own copy of the slave now
+	slave.Close()
+
+	if interactive {
+		go io.Copy(master, os.Stdin)
+	}
+
+	// Reading the master fails with EIO once every slave is closed,
+	// which marks the end of the container's output
+	output := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, master)
+		close(output)
+	}()
+
+	err = cmd.Wait()
+	<-output
+	return err
+}
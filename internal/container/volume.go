@@ -0,0 +1,333 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/fsutil"
+)
+
+// Mount describes a filesystem mounted into the container rootfs.
+type Mount struct {
+	// Type is the filesystem type; empty for bind mounts, "tmpfs" for tmpfs mounts
+	Type string `json:"type,omitempty"`
+
+	// Source is the absolute host path to mount (bind mounts only)
+	Source string `json:"source,omitempty"`
+
+	// Target is the absolute path inside the container
+	Target string `json:"target"`
+
+	// ReadOnly mounts the source read-only inside the container
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Data holds filesystem specific mount options (e.g. "size=64m" for tmpfs)
+	Data string `json:"data,omitempty"`
+
+	// Seed copies the rootfs content at Target into Source before mounting
+	Seed bool `json:"seed,omitempty"`
+}
+
+// parseTmpfsSpec parses a --tmpfs flag value of the form "target[:options]",
+// where options are passed to the tmpfs mount (e.g. "/run:size=64m,mode=755").
+func parseTmpfsSpec(spec string) (Mount, error) {
+	target, data, _ := strings.Cut(spec, ":")
+	target = filepath.Clean(target)
+	if !filepath.IsAbs(target) {
+		return Mount{}, fmt.Errorf("invalid tmpfs %q: target must be an absolute path", spec)
+	}
+	return Mount{Type: "tmpfs", Target: target, Data: data}, nil
+}
+
+// parseVolumeSpec parses a -v flag value of the form
+// "source:target[:ro|rw]". The source is either a host path or the name
+// of a named volume, which is created under config.VolumeDir on first use.
+func parseVolumeSpec(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Mount{}, fmt.Errorf("invalid volume %q: expected source:target[:ro|rw]", spec)
+	}
+
+	m := Mount{Target: filepath.Clean(parts[1])}
+	if !filepath.IsAbs(m.Target) {
+		return Mount{}, fmt.Errorf("invalid volume %q: target must be an absolute path", spec)
+	}
+
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return Mount{}, fmt.Errorf("invalid volume %q: unknown mode %s", spec, parts[2])
+		}
+	}
+
+	source := parts[0]
+	if !strings.ContainsRune(source, '/') && !strings.HasPrefix(source, ".") {
+		// Named volume
+		dataDir, err := createVolume(source)
+		if err != nil {
+			return Mount{}, err
+		}
+		m.Source = dataDir
+		return m, nil
+	}
+
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return Mount{}, fmt.Errorf("failed to resolve volume source %s: %w", source, err)
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return Mount{}, fmt.Errorf("volume source %s: %w", abs, err)
+	}
+	m.Source = abs
+	return m, nil
+}
+
+// createVolume creates the data directory of a volume if it does not exist
+// yet and returns its absolute path.
+func createVolume(name string) (string, error) {
+	dataDir, err := filepath.Abs(filepath.Join(config.VolumeDir, name, "_data"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve volume %s: %w", name, err)
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	return dataDir, nil
+}
+
+// createAnonymousVolume creates a new volume for a path declared with VOLUME
+// in the image. The volume is seeded with the image's content at that path
+// by the child process, once the rootfs is mounted.
+func createAnonymousVolume() (string, string, error) {
+	name, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+
+	dataDir, err := createVolume(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	return name, dataDir, nil
+}
+
+// seedVolume copies the rootfs content at seed, the resolved mount target,
+// into the volume.
+func seedVolume(seed string, m Mount) error {
+	if info, err := os.Stat(seed); err != nil || !info.IsDir() {
+		return nil
+	}
+
+	config.Log.Debugf("Seeding volume %s from %s", m.Source, seed)
+	if err := fsutil.CopyDir(seed, m.Source); err != nil {
+		return fmt.Errorf("failed to seed volume at %s: %w", m.Target, err)
+	}
+	return nil
+}
+
+// removeVolume deletes a volume and its data.
+func removeVolume(name string) error {
+	if err := os.RemoveAll(filepath.Join(config.VolumeDir, name)); err != nil {
+		return fmt.Errorf("failed to remove volume %s: %w", name, err)
+	}
+	return nil
+}
+
+// resolveMounts merges the user supplied volumes and tmpfs mounts with the
+// volumes declared by the image. Each declared path that is not covered by
+// an explicit mount gets a fresh anonymous volume, whose name is returned
+// alongside the mounts.
+func resolveMounts(opts Options, declared []string) ([]Mount, []string, error) {
+	var mounts []Mount
+	explicit := map[string]bool{}
+
+	for _, spec := range opts.Volumes {
+		m, err := parseVolumeSpec(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		explicit[m.Target] = true
+		mounts = append(mounts, m)
+	}
+
+	for _, spec := range opts.Tmpfs {
+		m, err := parseTmpfsSpec(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		explicit[m.Target] = true
+		mounts = append(mounts, m)
+	}
+
+	var anonymous []string
+	for _, target := range declared {
+		if explicit[target] {
+			continue
+		}
+		name, dataDir, err := createAnonymousVolume()
+		if err != nil {
+			return nil, anonymous, err
+		}
+		anonymous = append(anonymous, name)
+		mounts = append(mounts, Mount{Source: dataDir, Target: target, Seed: true})
+	}
+
+	return mounts, anonymous, nil
+}
+
+// setupMounts mounts the given mounts into the rootfs.
+// It must run in the container's mount namespace before pivot_root,
+// while host paths are still reachable.
+func setupMounts(rootfs string, mounts []Mount) error {
+	for _, m := range mounts {
+		target, err := prepareMountpoint(rootfs, m)
+		if err != nil {
+			return err
+		}
+
+		if m.Type == "tmpfs" {
+			config.Log.Debugf("Mounting tmpfs at %s", target)
+			if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, m.Data); err != nil {
+				return fmt.Errorf("failed to mount tmpfs at %s: %w", m.Target, err)
+			}
+			continue
+		}
+
+		config.Log.Debugf("Mounting %s at %s", m.Source, target)
+		if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s at %s: %w", m.Source, m.Target, err)
+		}
+
+		if m.ReadOnly {
+			flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+			if err := syscall.Mount("", target, "", flags, ""); err != nil {
+				return fmt.Errorf("failed to remount %s read-only: %w", m.Target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareMountpoint resolves the target of a mount within the rootfs, seeds
+// the volume from it if requested, and creates the mount point.
+//
+// Symbolic links of the image are resolved as if the rootfs were the root,
+// like COPY does, so that a link such as /data -> /etc cannot make the
+// mount, which happens before pivot_root, land on a host path.
+//
+// Parameters:
+//   - rootfs: The path of the container's root filesystem on the host
+//   - m: The mount to prepare
+//
+// Returns:
+//   - string: The host path to mount at
+//   - error: Any error encountered while resolving or creating the mount point
+func prepareMountpoint(rootfs string, m Mount) (string, error) {
+	target, err := archive.SecureJoin(rootfs, m.Target)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve mount point %s: %w", m.Target, err)
+	}
+
+	if m.Type == "tmpfs" {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		if m.Seed {
+			if err := seedVolume(target, m); err != nil {
+				return "", err
+			}
+		}
+		err = createMountpoint(m.Source, target)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create mount point %s: %w", m.Target, err)
+	}
+	return target, nil
+}
+
+// createMountpoint makes sure target exists with the same kind
+// (file or directory) as source.
+func createMountpoint(source, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// MissingMountpoints returns the paths of the root filesystem at root that
+// the mount points of mounts will create: the targets and their missing
+// parent directories, parents first.
+func MissingMountpoints(root string, mounts []Mount) []string {
+	var missing []string
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		var created []string
+		for p := m.Target; p != "/"; p = path.Dir(p) {
+			host, err := archive.SecureJoin(root, p)
+			if err != nil {
+				break
+			}
+			if _, err := os.Lstat(host); err == nil {
+				break
+			}
+			created = append(created, p)
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			if !seen[created[i]] {
+				seen[created[i]] = true
+				missing = append(missing, created[i])
+			}
+		}
+	}
+	return missing
+}
+
+// RemoveMountpoints removes the mount points returned by MissingMountpoints
+// once the mounts are gone, so that they do not become part of a layer.
+// Parent directories the command wrote into are kept.
+func RemoveMountpoints(root string, paths []string) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		parent, err := archive.SecureJoin(root, path.Dir(paths[i]))
+		if err != nil {
+			continue
+		}
+		// Directories that are not empty are not removed
+		os.Remove(filepath.Join(parent, path.Base(paths[i])))
+	}
+}
+
+// randomID returns a random hex identifier of config.IDLength characters.
+func randomID() (string, error) {
+	b := make([]byte, (config.IDLength+1)/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate ID: %w", err)
+	}
+	return hex.EncodeToString(b)[:config.IDLength], nil
+}
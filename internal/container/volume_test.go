@@ -0,0 +1,110 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareMountpointStaysInRootfs(t *testing.T) {
+	base := t.TempDir()
+	rootfs := filepath.Join(base, "rootfs")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(rootfs, outside), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, outside, "seed"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "seed"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The image's links point at the host directory, absolutely and relatively
+	for name, target := range map[string]string{"abs": outside, "rel": "../outside", "up": "../../../.."} {
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sourceFile := filepath.Join(base, "source")
+	if err := os.WriteFile(sourceFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		mount Mount
+		want  string
+	}{
+		{"tmpfs below absolute link", Mount{Type: "tmpfs", Target: "/abs/tmp"}, filepath.Join(rootfs, outside, "tmp")},
+		{"volume below relative link", Mount{Source: t.TempDir(), Target: "/rel/vol"}, filepath.Join(rootfs, "outside", "vol")},
+		{"file below parent link", Mount{Source: sourceFile, Target: "/up/file"}, filepath.Join(rootfs, "file")},
+		{"link as target", Mount{Type: "tmpfs", Target: "/rel"}, filepath.Join(rootfs, "outside")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := prepareMountpoint(rootfs, tt.mount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target != tt.want {
+				t.Errorf("mount point %s, want %s", target, tt.want)
+			}
+			if _, err := os.Stat(target); err != nil {
+				t.Errorf("mount point was not created: %v", err)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("created %d entries outside the rootfs", len(entries)-1)
+	}
+}
+
+func TestPrepareMountpointSeedsFromRootfs(t *testing.T) {
+	base := t.TempDir()
+	rootfs := filepath.Join(base, "rootfs")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(rootfs, "etc"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "seed"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "seed"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(rootfs, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(rootfs, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]string{"/data": "image", "/escape": ""} {
+		t.Run(target, func(t *testing.T) {
+			volume := t.TempDir()
+			if _, err := prepareMountpoint(rootfs, Mount{Source: volume, Target: target, Seed: true}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(volume, "seed"))
+			if want == "" {
+				if err == nil {
+					t.Fatalf("volume was seeded with %q from outside the rootfs", data)
+				}
+				return
+			}
+			if err != nil || string(data) != want {
+				t.Fatalf("volume seeded with %q (%v), want %q", data, err, want)
+			}
+		})
+	}
+}
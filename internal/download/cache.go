@@ -0,0 +1,120 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/fsutil"
+)
+
+// The download cache stores each downloaded file once, named after its
+// SHA-256 digest, and records the digest of the content of each URL:
+//
+//	tmp/cache/downloads/sha256/<hex>
+//	tmp/cache/downloads/urls.json
+
+// lookup returns the cached content for a URL: by checksum if one is
+// given, so that the content is found whichever URL it came from, and
+// by URL otherwise.
+func lookup(url, checksum string) (string, bool) {
+	digest := checksum
+	if digest == "" {
+		urls, err := readURLs()
+		if err != nil {
+			config.Log.Warnf("Failed to read download cache: %v", err)
+			return "", false
+		}
+		digest = urls[url]
+	}
+	if digest == "" {
+		return "", false
+	}
+
+	path := blobPath(digest)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// createPartial creates the file receiving a download in progress.
+func createPartial() (*os.File, error) {
+	if err := os.MkdirAll(config.DownloadDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create download cache: %w", err)
+	}
+	f, err := os.CreateTemp(config.DownloadDir, "partial-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download cache file: %w", err)
+	}
+	return f, nil
+}
+
+// store moves a completed download into the cache under its digest and
+// records it as the content of the URL.
+func store(f *os.File, url, digest string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	path := blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	urls, err := readURLs()
+	if err != nil {
+		return err
+	}
+	urls[url] = digest
+	data, err := json.MarshalIndent(urls, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := urlsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, urlsPath())
+}
+
+// Prune removes the download cache and returns the space it occupied.
+func Prune() (int64, error) {
+	size, err := fsutil.DirSize(config.DownloadDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.RemoveAll(config.DownloadDir); err != nil {
+		return 0, fmt.Errorf("failed to remove download cache: %w", err)
+	}
+	return size, nil
+}
+
+func readURLs() (map[string]string, error) {
+	urls := map[string]string{}
+	data, err := os.ReadFile(urlsPath())
+	if os.IsNotExist(err) {
+		return urls, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", urlsPath(), err)
+	}
+	return urls, nil
+}
+
+func blobPath(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(config.DownloadDir, algorithm, hex)
+}
+
+func urlsPath() string {
+	return filepath.Join(config.DownloadDir, "urls.json")
+}
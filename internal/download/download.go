@@ -0,0 +1,285 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// maxAttempts bounds the number of consecutive failed requests of a download.
+const maxAttempts = 5
+
+// client sends download requests. Its transport honors the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables.
+var client = &http.Client{Transport: http.DefaultTransport}
+
+// Open returns the content of a URL. Content downloaded before is read
+// from the download cache without contacting the server; otherwise it is
+// streamed from the server while being written to the cache.
+//
+// Interrupted transfers are retried, resuming with HTTP range requests
+// where the server supports them. If checksum is not empty, e.g.
+// "sha256:<hex>", the content must match it: reading the end of a
+// mismatching download returns an error and the content is not cached.
+// Content is only cached once it has been read to the end.
+//
+// Parameters:
+//   - url: The URL to download
+//   - checksum: The expected digest of the content, or ""
+//
+// Returns:
+//   - io.ReadCloser: The content of the URL
+//   - error: Any error encountered while starting the download
+func Open(url, checksum string) (io.ReadCloser, error) {
+	if path, ok := lookup(url, checksum); ok {
+		config.Log.Infof("Using cached download of %s", url)
+		return os.Open(path)
+	}
+
+	file, err := createPartial()
+	if err != nil {
+		return nil, err
+	}
+	d := &download{url: url, checksum: checksum, file: file, hash: sha256.New(), size: -1}
+	if err := d.request(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	d.progress = newProgress(path.Base(url), d.size)
+	return d, nil
+}
+
+// download streams the content of a URL, retrying and resuming the
+// transfer on transient failures.
+type download struct {
+	url      string
+	checksum string
+
+	// resp is the response currently being read, nil after a failure
+	resp *http.Response
+
+	// offset is the number of bytes read so far
+	offset int64
+
+	// size is the length of the content, -1 if the server did not send it
+	size int64
+
+	// validator identifies the version of the content (ETag or
+	// Last-Modified), so that a resumed transfer continues the same content
+	validator string
+
+	// attempts counts the failed requests since data was last received
+	attempts int
+
+	// file receives the content for the download cache
+	file *os.File
+	hash hash.Hash
+
+	progress *progress
+	done     bool
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	if d.done {
+		return 0, io.EOF
+	}
+	for {
+		if d.resp == nil {
+			if err := d.request(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := d.resp.Body.Read(p)
+		if n > 0 {
+			if _, werr := d.file.Write(p[:n]); werr != nil {
+				return n, fmt.Errorf("failed to write download cache: %w", werr)
+			}
+			d.hash.Write(p[:n])
+			d.offset += int64(n)
+			d.attempts = 0
+			d.progress.update(d.offset)
+		}
+
+		if err == io.EOF && (d.size < 0 || d.offset >= d.size) {
+			if err := d.finish(); err != nil {
+				return n, err
+			}
+			return n, io.EOF
+		}
+		if err != nil {
+			// The connection broke or ended early: resume with a new request
+			config.Log.Warnf("Download of %s interrupted at %d bytes: %v", d.url, d.offset, err)
+			d.resp.Body.Close()
+			d.resp = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, nil
+	}
+}
+
+// request starts or resumes the transfer, retrying transient failures
+// with an increasing delay.
+func (d *download) request() error {
+	var lastErr error
+	for d.attempts < maxAttempts {
+		if d.attempts > 0 {
+			delay := time.Duration(1<<(d.attempts-1)) * time.Second
+			config.Log.Infof("Retrying download of %s in %s", d.url, delay)
+			time.Sleep(delay)
+		}
+		d.attempts++
+
+		resp, err := d.get()
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := d.accept(resp); err != nil {
+			resp.Body.Close()
+			if _, ok := err.(permanentError); ok {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		d.resp = resp
+		return nil
+	}
+	return fmt.Errorf("failed to download %s after %d attempts: %w", d.url, maxAttempts, lastErr)
+}
+
+// get sends a request for the content from the current offset on.
+func (d *download) get() (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	if d.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+		config.Log.Debugf("Resuming download of %s at byte %d", d.url, d.offset)
+	}
+	return client.Do(req)
+}
+
+// accept checks a response and positions it at the current offset.
+func (d *download) accept(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.offset > 0:
+		start, err := rangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != d.offset {
+			return fmt.Errorf("unexpected range %q in response", resp.Header.Get("Content-Range"))
+		}
+		return nil
+
+	case resp.StatusCode == http.StatusOK:
+		if d.offset == 0 {
+			d.size = resp.ContentLength
+			d.validator = validator(resp)
+			return nil
+		}
+		// The server ignored the range request: skip what was read before,
+		// unless the content changed in the meantime
+		if v := validator(resp); d.validator == "" || v != d.validator {
+			return permanentError{fmt.Errorf("content of %s changed during the download", d.url)}
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, d.offset); err != nil {
+			return err
+		}
+		return nil
+
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("server responded %s", resp.Status)
+
+	default:
+		return permanentError{fmt.Errorf("failed to download %s: %s", d.url, resp.Status)}
+	}
+}
+
+// finish verifies the completed download and adds it to the cache.
+func (d *download) finish() error {
+	d.done = true
+	d.progress.finish()
+
+	digest := "sha256:" + hex.EncodeToString(d.hash.Sum(nil))
+	if d.checksum != "" && digest != d.checksum {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", d.url, d.checksum, digest)
+	}
+	if d.checksum != "" {
+		config.Log.Debugf("Verified checksum %s of %s", d.checksum, d.url)
+	}
+
+	// The content was delivered; failing to cache it is not fatal
+	if err := store(d.file, d.url, digest); err != nil {
+		config.Log.Warnf("Failed to cache download of %s: %v", d.url, err)
+		os.Remove(d.file.Name())
+	}
+	d.file = nil
+	return nil
+}
+
+// Close stops the download. Incomplete content is discarded.
+func (d *download) Close() error {
+	if d.resp != nil {
+		d.resp.Body.Close()
+		d.resp = nil
+	}
+	if d.file != nil {
+		d.file.Close()
+		os.Remove(d.file.Name())
+		d.file = nil
+	}
+	return nil
+}
+
+// permanentError is a download failure that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// validator returns the value identifying the version of a response's
+// content, for If-Range requests.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// rangeStart returns the first byte position of a Content-Range header
+// such as "bytes 100-199/200".
+func rangeStart(header string) (int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	return strconv.ParseInt(start, 10, 64)
+}
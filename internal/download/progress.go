@@ -0,0 +1,53 @@
+package download
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lariskovski/containy/internal/term"
+)
+
+// progressInterval is the minimum time between progress updates.
+const progressInterval = 200 * time.Millisecond
+
+// progress reports the bytes received by a download on a single,
+// continuously rewritten line of the terminal. Nothing is printed when
+// standard error is not a terminal, e.g. in CI logs.
+type progress struct {
+	label   string
+	total   int64
+	current int64
+	printed time.Time
+	enabled bool
+}
+
+func newProgress(label string, total int64) *progress {
+	return &progress{label: label, total: total, enabled: term.IsTerminal(os.Stderr)}
+}
+
+// update records the number of bytes received so far.
+func (p *progress) update(current int64) {
+	p.current = current
+	if p.enabled && time.Since(p.printed) >= progressInterval {
+		p.print()
+	}
+}
+
+// finish prints the final state and ends the progress line.
+func (p *progress) finish() {
+	if p.enabled && !p.printed.IsZero() {
+		p.print()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) print() {
+	p.printed = time.Now()
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r\033[KDownloading %s: %s / %s (%d%%)",
+			p.label, term.HumanSize(p.current), term.HumanSize(p.total), p.current*100/p.total)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[KDownloading %s: %s", p.label, term.HumanSize(p.current))
+}
@@ -0,0 +1,121 @@
+package fsutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CopyDir recursively copies the contents of src into dst, preserving file
+// modes, ownership and symbolic links. dst is created if it does not exist.
+func CopyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if err := CopyEntry(path, target, info); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// CopyEntry copies a single filesystem entry (directory, regular file or
+// symlink) described by info from src to dst. Directories are created but
+// their contents are not copied.
+func CopyEntry(src, dst string, info os.FileInfo) error {
+	uid, gid := -1, -1
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+	return CopyEntryWithOwner(src, dst, info, uid, gid)
+}
+
+// CopyEntryWithOwner copies a single filesystem entry like CopyEntry, but
+// gives dst the owner uid:gid instead of the owner of src. An ID of -1
+// leaves it unchanged.
+func CopyEntryWithOwner(src, dst string, info os.FileInfo, uid, gid int) error {
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if err := os.MkdirAll(dst, mode.Perm()); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		if err := copyFile(src, dst, mode); err != nil {
+			return err
+		}
+	default:
+		// Devices, sockets and FIFOs are not copied
+		return nil
+	}
+
+	if err := os.Lchown(dst, uid, gid); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Apply the full mode last: the umask and chown both strip bits
+	return os.Chmod(dst, FileMode(info.Mode()))
+}
+
+// FileMode returns the permission bits of mode including setuid, setgid
+// and sticky bits, suitable for os.Chmod.
+func FileMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() | mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DirSize returns the total size in bytes of the regular files under path.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,218 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of the file, next to the build file, listing the
+// paths of the build context that instructions do not see.
+const FileName = ".tainyignore"
+
+// Matcher decides which files of a build context are excluded, following
+// the semantics of Docker's .dockerignore:
+//   - each line is a pattern relative to the context root; empty lines and
+//     lines starting with "#" are skipped
+//   - "*" matches any sequence of characters except "/", "?" a single one,
+//     and "[...]" a character class
+//   - "**" matches any number of directories, including none
+//   - a pattern excluding a directory excludes everything below it
+//   - a pattern starting with "!" re-includes what earlier patterns excluded;
+//     the last matching pattern decides
+//
+// A nil Matcher excludes nothing.
+type Matcher struct {
+	root     string
+	patterns []pattern
+
+	// exceptions is set if any pattern re-includes files, so that excluded
+	// directories must still be searched for them
+	exceptions bool
+}
+
+// pattern is a compiled line of an ignore file.
+type pattern struct {
+	re *regexp.Regexp
+
+	// exception marks a pattern starting with "!"
+	exception bool
+}
+
+// Load reads the ignore file of a build. It is looked up next to the build
+// file, as <file>.tainyignore or as .tainyignore in the same directory, and
+// then at the root of the context. Its patterns are relative to the context
+// root wherever it is found. A build without one gets a Matcher that
+// excludes nothing.
+//
+// Parameters:
+//   - root: The build context directory
+//   - file: The path of the build file
+//
+// Returns:
+//   - *Matcher: The patterns of the build's ignore file
+//   - error: Any error encountered while reading or parsing the file
+func Load(root, file string) (*Matcher, error) {
+	m := &Matcher{root: root}
+
+	f, err := openFile(root, file)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return m, nil
+	}
+	defer f.Close()
+	name := f.Name()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := pattern{}
+		if rest, ok := strings.CutPrefix(line, "!"); ok {
+			p.exception = true
+			line = strings.TrimSpace(rest)
+		}
+		line = filepath.ToSlash(filepath.Clean(line))
+		if line != "/" {
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		if p.re, err = compile(line); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %w", line, name, err)
+		}
+		m.patterns = append(m.patterns, p)
+		m.exceptions = m.exceptions || p.exception
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return m, nil
+}
+
+// openFile opens the first ignore file found for the build file, or
+// returns nil if there is none.
+func openFile(root, file string) (*os.File, error) {
+	candidates := []string{
+		file + FileName,
+		filepath.Join(filepath.Dir(file), FileName),
+		filepath.Join(root, FileName),
+	}
+	for _, name := range candidates {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// Excludes reports whether the file or directory at path, inside the
+// context root, is excluded. Paths outside the root are never excluded.
+func (m *Matcher) Excludes(path string) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	excluded := false
+	for _, p := range m.patterns {
+		// Only exceptions can change the outcome for an excluded path, and
+		// only exclusions for an included one
+		if p.exception != excluded {
+			continue
+		}
+		if matchesOrParentMatches(p.re, rel) {
+			excluded = !p.exception
+		}
+	}
+	return excluded
+}
+
+// SkipsDir reports whether the directory at path is excluded along with all
+// of its content, so that it does not need to be searched.
+func (m *Matcher) SkipsDir(path string) bool {
+	return m.Excludes(path) && !m.exceptions
+}
+
+// matchesOrParentMatches reports whether re matches rel or one of its
+// parent directories.
+func matchesOrParentMatches(re *regexp.Regexp, rel string) bool {
+	for {
+		if re.MatchString(rel) {
+			return true
+		}
+		i := strings.LastIndex(rel, "/")
+		if i < 0 {
+			return false
+		}
+		rel = rel[:i]
+	}
+}
+
+// compile converts a pattern to a regular expression matching whole
+// slash-separated paths.
+func compile(p string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				i++
+				// "**/" matches any number of directories, a trailing "**"
+				// everything below
+				if i+1 < len(p) && p[i+1] == '/' {
+					i++
+				}
+				if i+1 == len(p) {
+					b.WriteString(".*")
+				} else {
+					b.WriteString("(.*/)?")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := p[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 == len(p) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,170 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadPatterns writes an ignore file with the given content at the root of
+// a new context and loads it.
+func loadPatterns(t *testing.T, content string) (*Matcher, string) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, FileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(root, filepath.Join(root, "TainyFile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, root
+}
+
+func TestExcludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		path     string
+		excluded bool
+	}{
+		{"name", "node_modules", "node_modules", true},
+		{"below excluded directory", "node_modules", "node_modules/a/b.js", true},
+		{"name only at root", "node_modules", "web/node_modules", false},
+		{"star", "*.log", "debug.log", true},
+		{"star does not cross directories", "*.log", "logs/debug.log", false},
+		{"star inside path", "logs/*.log", "logs/debug.log", true},
+		{"double star prefix", "**/*.log", "a/b/debug.log", true},
+		{"double star prefix at root", "**/*.log", "debug.log", true},
+		{"double star middle", "a/**/b", "a/x/y/b", true},
+		{"double star middle without directories", "a/**/b", "a/b", true},
+		{"double star suffix", "a/**", "a/x/y", true},
+		{"double star alone", "**", "any/path", true},
+		{"question mark", "?.md", "a.md", true},
+		{"question mark single character", "?.md", "ab.md", false},
+		{"character class", "[abc].txt", "b.txt", true},
+		{"character class miss", "[abc].txt", "d.txt", false},
+		{"negated character class", "[!abc].txt", "d.txt", true},
+		{"negated character class miss", "[!abc].txt", "a.txt", false},
+		{"range", "file[0-9]", "file7", true},
+		{"leading slash", "/dist", "dist/app.js", true},
+		{"leading slash only at root", "/dist", "web/dist", false},
+		{"trailing slash", "build/", "build/out.o", true},
+		{"dot segments", "./tmp/../cache", "cache/x", true},
+		{"escaped star", `\*`, "*", true},
+		{"escaped star is literal", `\*`, "x", false},
+		{"escaped hash", `\#notes`, "#notes", true},
+		{"comment", "#notes", "#notes", false},
+		{"blank lines and spaces", "\n  secret.txt  \n\n", "secret.txt", true},
+		{"exception", "*.md\n!README.md", "README.md", false},
+		{"exception leaves others excluded", "*.md\n!README.md", "CHANGES.md", true},
+		{"exception below excluded directory", "docs\n!docs/README.md", "docs/README.md", false},
+		{"exception keeps directory excluded", "docs\n!docs/README.md", "docs/guide.md", true},
+		{"exception with double star", "**/*.log\n!**/keep.log", "a/keep.log", false},
+		{"last match decides", "*.md\n!README.md\nREADME.md", "README.md", true},
+		{"exception before exclusion", "!README.md\n*.md", "README.md", true},
+		{"exception without exclusion", "!README.md", "README.md", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, root := loadPatterns(t, tt.patterns)
+			if got := m.Excludes(filepath.Join(root, tt.path)); got != tt.excluded {
+				t.Errorf("Excludes(%q) with patterns %q = %v, want %v", tt.path, tt.patterns, got, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestExcludesOutsideRoot(t *testing.T) {
+	m, root := loadPatterns(t, "**")
+	for _, path := range []string{root, filepath.Dir(root), filepath.Join(root, "..", "other")} {
+		if m.Excludes(path) {
+			t.Errorf("excluded %s, which is not inside the context", path)
+		}
+	}
+
+	var nilMatcher *Matcher
+	if nilMatcher.Excludes(filepath.Join(root, "x")) || nilMatcher.SkipsDir(filepath.Join(root, "x")) {
+		t.Error("nil Matcher excluded a path")
+	}
+}
+
+func TestSkipsDir(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		dir      string
+		skipped  bool
+	}{
+		{"excluded directory", "node_modules", "node_modules", true},
+		{"below excluded directory", "node_modules", "node_modules/pkg", true},
+		{"included directory", "node_modules", "src", false},
+		// Files below an excluded directory may be re-included, so it is
+		// searched as long as there are exceptions
+		{"exception below directory", "docs\n!docs/README.md", "docs", false},
+		{"exception elsewhere", "node_modules\n!*.md", "node_modules", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, root := loadPatterns(t, tt.patterns)
+			if got := m.SkipsDir(filepath.Join(root, tt.dir)); got != tt.skipped {
+				t.Errorf("SkipsDir(%q) with patterns %q = %v, want %v", tt.dir, tt.patterns, got, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestLoadInvalidPattern(t *testing.T) {
+	for _, patterns := range []string{"[abc", `trailing\`} {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, FileName), []byte(patterns), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(root, filepath.Join(root, "TainyFile")); err == nil {
+			t.Errorf("loaded invalid pattern %q", patterns)
+		}
+	}
+}
+
+func TestLoadFindsFileNextToBuildFile(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "build")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "TainyFile")
+	files := map[string]string{
+		file + FileName:               "file-specific",
+		filepath.Join(dir, FileName):  "build-directory",
+		filepath.Join(root, FileName): "context-root",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each file takes precedence over the following ones
+	for _, next := range []struct{ found, remove string }{
+		{"file-specific", file + FileName},
+		{"build-directory", filepath.Join(dir, FileName)},
+		{"context-root", filepath.Join(root, FileName)},
+		{"", ""},
+	} {
+		m, err := Load(root, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pattern := range []string{"file-specific", "build-directory", "context-root"} {
+			// Patterns are relative to the context root wherever the file is
+			if got, want := m.Excludes(filepath.Join(root, pattern)), pattern == next.found; got != want {
+				t.Errorf("with %s, Excludes(%s) = %v, want %v", next.found, pattern, got, want)
+			}
+		}
+		if next.remove != "" {
+			if err := os.Remove(next.remove); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// Config holds the runtime defaults recorded for an image during its build.
+// Instructions that do not change the filesystem (e.g. VOLUME) only update
+// this structure, which is then consulted by `containy run`.
+type Config struct {
+	// Volumes lists the container paths declared with VOLUME instructions
+	Volumes []string `json:"volumes,omitempty"`
+
+	// Labels holds the key/value metadata set with LABEL instructions
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Env is the default environment of the image's containers (KEY=VALUE)
+	Env []string `json:"env,omitempty"`
+
+	// WorkingDir is the default working directory of the image's containers
+	WorkingDir string `json:"workingDir,omitempty"`
+
+	// User is the default user[:group] of the image's containers
+	User string `json:"user,omitempty"`
+
+	// Entrypoint is the executable run by the image's containers, with its
+	// first arguments; the command given to `containy run` is appended
+	Entrypoint []string `json:"entrypoint,omitempty"`
+
+	// Cmd is the default command, or the default arguments of the entrypoint
+	Cmd []string `json:"cmd,omitempty"`
+}
+
+// ReadOnlyLabel is the image label that makes containers of the image run
+// with a read-only root filesystem by default (e.g. LABEL containy.read-only=true).
+const ReadOnlyLabel = "containy.read-only"
+
+// ReadOnly reports whether the image asks for a read-only root filesystem.
+func (c *Config) ReadOnly() bool {
+	v, err := strconv.ParseBool(c.Labels[ReadOnlyLabel])
+	return err == nil && v
+}
+
+// SetLabel sets an image label, replacing any previous value.
+func (c *Config) SetLabel(key, value string) {
+	if c.Labels == nil {
+		c.Labels = map[string]string{}
+	}
+	c.Labels[key] = value
+}
+
+// AddVolume records a container path as a volume, ignoring duplicates.
+func (c *Config) AddVolume(path string) {
+	path = filepath.Clean(path)
+	for _, v := range c.Volumes {
+		if v == path {
+			return
+		}
+	}
+	c.Volumes = append(c.Volumes, path)
+}
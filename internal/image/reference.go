@@ -0,0 +1,134 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTag is the tag assumed when a reference has neither a tag nor a digest.
+const DefaultTag = "latest"
+
+// maxNameLength is the maximum length of a repository name, including its host.
+const maxNameLength = 255
+
+var (
+	// domainPattern matches a registry host: dot separated DNS labels with an optional port
+	domainPattern = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+
+	// componentPattern matches a path component, e.g. "team" or "my_app.v2"
+	componentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+
+	// tagPattern matches a tag, e.g. "1.2" or "latest"
+	tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+
+	// digestPattern matches a SHA-256 content digest
+	digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference is a parsed image reference of the form
+// [host[:port]/]path[:tag][@sha256:digest].
+type Reference struct {
+	// Domain is the registry host, empty for local names
+	Domain string
+
+	// Path is the repository path, e.g. "team/app"
+	Path string
+
+	// Tag is the tag, empty if the reference only has a digest
+	Tag string
+
+	// Digest is the content digest ("sha256:<hex>"), empty if not given
+	Digest string
+}
+
+// ParseReference parses and validates an image reference. References
+// without a tag or digest get the "latest" tag.
+//
+// The first path component is taken as the registry host if it contains a
+// '.' or ':', or is "localhost", as in "registry.example.com:5000/team/app".
+//
+// Parameters:
+//   - s: The reference to parse, e.g. "myapp:1.2" or "registry/team/app@sha256:..."
+//
+// Returns:
+//   - Reference: The parsed reference
+//   - error: A description of why the reference is invalid
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	if s == "" {
+		return ref, fmt.Errorf("invalid reference format: empty image name")
+	}
+
+	name := s
+	if before, digest, ok := strings.Cut(name, "@"); ok {
+		if !digestPattern.MatchString(digest) {
+			return ref, fmt.Errorf("invalid reference %q: digest must be sha256: followed by 64 lowercase hex characters", s)
+		}
+		name, ref.Digest = before, digest
+	}
+
+	// A colon after the last slash separates the tag; earlier colons belong to a host port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		tag := name[i+1:]
+		if !tagPattern.MatchString(tag) {
+			return ref, fmt.Errorf("invalid reference %q: tag %q must be at most 128 letters, digits, '_', '.' or '-', not starting with '.' or '-'", s, tag)
+		}
+		name, ref.Tag = name[:i], tag
+	}
+
+	if len(name) > maxNameLength {
+		return ref, fmt.Errorf("invalid reference %q: repository name must not be longer than %d characters", s, maxNameLength)
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && isDomain(components[0]) {
+		if !domainPattern.MatchString(components[0]) {
+			return ref, fmt.Errorf("invalid reference %q: invalid registry host %q", s, components[0])
+		}
+		ref.Domain = components[0]
+		components = components[1:]
+	}
+	for _, c := range components {
+		if c == "" {
+			return ref, fmt.Errorf("invalid reference %q: empty path component", s)
+		}
+		if strings.ToLower(c) != c {
+			return ref, fmt.Errorf("invalid reference %q: repository name must be lowercase", s)
+		}
+		if !componentPattern.MatchString(c) {
+			return ref, fmt.Errorf("invalid reference %q: path component %q must consist of lowercase letters and digits, separated by '.', '_', '__' or '-'", s, c)
+		}
+	}
+	ref.Path = strings.Join(components, "/")
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// isDomain reports whether the first component of a name is a registry host.
+func isDomain(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// Name returns the repository name, including the registry host if any.
+func (r Reference) Name() string {
+	if r.Domain == "" {
+		return r.Path
+	}
+	return r.Domain + "/" + r.Path
+}
+
+// String returns the normalized form of the reference, as stored in the image store.
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,449 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/overlay"
+)
+
+// digestPrefix is the algorithm prefix of image IDs.
+const digestPrefix = "sha256:"
+
+// Image is the manifest of a built image, stored as JSON under
+// config.ImageDir and addressed by the SHA-256 digest of its content.
+type Image struct {
+	// ID is the content digest of the manifest ("sha256:<hex>").
+	// It is derived from the stored content and therefore not part of it.
+	ID string `json:"-"`
+
+	// Layers are the IDs of the image's layers, from the base layer to the top layer
+	Layers []string `json:"layers"`
+
+	// Config holds the runtime defaults of the image
+	Config Config `json:"config"`
+
+	// Created is the time the image was built
+	Created time.Time `json:"created"`
+
+	// History records the instructions the image was built from
+	History []History `json:"history,omitempty"`
+
+	// Size is the total size of the image's layers in bytes
+	Size int64 `json:"size"`
+}
+
+// History describes the build instruction that produced a step of an image.
+type History struct {
+	// Created is the time the step was built
+	Created time.Time `json:"created"`
+
+	// CreatedBy is the instruction, e.g. "RUN apk add curl"
+	CreatedBy string `json:"createdBy"`
+
+	// LayerID is the layer created by the instruction, empty for metadata-only instructions
+	LayerID string `json:"layerId,omitempty"`
+
+	// EmptyLayer is true for instructions that only changed the configuration
+	EmptyLayer bool `json:"emptyLayer,omitempty"`
+
+	// Size is the size of the layer's content in bytes
+	Size int64 `json:"size,omitempty"`
+}
+
+// ShortID returns the abbreviated form of an image ID used for display.
+func (img *Image) ShortID() string {
+	id := strings.TrimPrefix(img.ID, digestPrefix)
+	if len(id) > config.IDLength {
+		id = id[:config.IDLength]
+	}
+	return id
+}
+
+// Save writes the manifest to the store and sets img.ID to its digest.
+// Saving identical manifests is idempotent.
+func Save(img *Image) error {
+	data, err := encode(img)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	img.ID = digestPrefix + hex.EncodeToString(sum[:])
+
+	if err := os.MkdirAll(manifestDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create image directory: %w", err)
+	}
+	if err := os.WriteFile(manifestPath(img.ID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write image manifest: %w", err)
+	}
+	return nil
+}
+
+// FindRebuilt returns the stored image that img is a rebuild of: one with
+// the same layers, configuration and history, ignoring when it and its
+// steps were created. A build whose steps were all cached thereby keeps the
+// ID of the image it built before, instead of storing a new manifest that
+// differs only in its timestamps.
+//
+// Parameters:
+//   - img: The manifest of the built image, not saved yet
+//
+// Returns:
+//   - *Image: The stored image, or nil if there is none
+//   - error: Any error encountered while reading the store
+func FindRebuilt(img *Image) (*Image, error) {
+	want, err := encode(withoutTimestamps(img))
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := List()
+	if err != nil {
+		return nil, err
+	}
+	for _, stored := range images {
+		data, err := encode(withoutTimestamps(stored))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(data, want) {
+			return stored, nil
+		}
+	}
+	return nil, nil
+}
+
+// withoutTimestamps returns a copy of the manifest with the creation times
+// of the image and of its history cleared.
+func withoutTimestamps(img *Image) *Image {
+	c := *img
+	c.Created = time.Time{}
+	c.History = make([]History, len(img.History))
+	for i, h := range img.History {
+		h.Created = time.Time{}
+		c.History[i] = h
+	}
+	return &c
+}
+
+// encode returns the stored form of a manifest.
+func encode(img *Image) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(img); err != nil {
+		return nil, fmt.Errorf("failed to encode image manifest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Load reads the manifest of the image with the given full ID.
+func Load(id string) (*Image, error) {
+	data, err := os.ReadFile(manifestPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no such image: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image manifest %s: %w", id, err)
+	}
+
+	img := &Image{}
+	if err := json.Unmarshal(data, img); err != nil {
+		return nil, fmt.Errorf("failed to decode image manifest %s: %w", id, err)
+	}
+	img.ID = id
+	return img, nil
+}
+
+// Resolve finds an image by reference (e.g. "myapp" or "myapp:1.2"), full
+// ID ("sha256:<hex>") or a unique prefix of its hex digest.
+func Resolve(ref string) (*Image, error) {
+	refs, err := readReferences()
+	if err != nil {
+		return nil, err
+	}
+	if parsed, err := ParseReference(ref); err == nil {
+		if id, ok := refs[parsed.String()]; ok {
+			return Load(id)
+		}
+		// A digest reference also matches the image with that ID
+		if parsed.Digest != "" {
+			if _, err := os.Stat(manifestPath(parsed.Digest)); err == nil {
+				return Load(parsed.Digest)
+			}
+		}
+	}
+
+	prefix := strings.TrimPrefix(ref, digestPrefix)
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("no such image: %s", ref)
+	}
+
+	ids, err := listIDs()
+	if err != nil {
+		return nil, err
+	}
+	var match string
+	for _, id := range ids {
+		if strings.HasPrefix(strings.TrimPrefix(id, digestPrefix), prefix) {
+			if match != "" {
+				return nil, fmt.Errorf("ambiguous image ID prefix: %s", ref)
+			}
+			match = id
+		}
+	}
+	if match == "" {
+		return nil, fmt.Errorf("no such image: %s", ref)
+	}
+	return Load(match)
+}
+
+// Tag points name at the image with the given ID. The name is stored in
+// its normalized form, with the default tag if none is given. If the name
+// already refers to another image, it is moved, leaving the previous image
+// untagged.
+func Tag(name, id string) error {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" {
+		return fmt.Errorf("cannot tag with a digest reference: %s", name)
+	}
+	name = ref.String()
+
+	refs, err := readReferences()
+	if err != nil {
+		return err
+	}
+	if previous, ok := refs[name]; ok && previous != id {
+		config.Log.Debugf("Moving %s from %s to %s", name, previous, id)
+	}
+
+	refs[name] = id
+	return writeReferences(refs)
+}
+
+// Names returns the names referring to the image with the given ID, sorted.
+func Names(id string) ([]string, error) {
+	refs, err := readReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, target := range refs {
+		if target == id {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// List returns all images in the store, most recently created first.
+func List() ([]*Image, error) {
+	ids, err := listIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*Image, 0, len(ids))
+	for _, id := range ids {
+		img, err := Load(id)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	return images, nil
+}
+
+// Remove removes an image reference. When ref is a name, only that name is
+// removed, unless it is the image's last one. When ref is an ID, all names
+// are removed, which requires force if there are several.
+//
+// An image without names is deleted together with the layers that no other
+// image uses. Callers are responsible for checking that no container uses it.
+//
+// Returns:
+//   - []string: The removed names and the deleted image ID
+//   - error: Any error encountered while removing the image
+func Remove(ref string, force bool) ([]string, error) {
+	img, err := Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := readReferences()
+	if err != nil {
+		return nil, err
+	}
+	names, err := Names(img.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	if name, isName := normalizedName(refs, ref); isName {
+		delete(refs, name)
+		removed = append(removed, name)
+	} else {
+		if len(names) > 1 && !force {
+			return nil, fmt.Errorf("image %s is referenced by multiple names (%s), use -f to remove all of them",
+				img.ShortID(), strings.Join(names, ", "))
+		}
+		for _, name := range names {
+			delete(refs, name)
+			removed = append(removed, name)
+		}
+	}
+	if err := writeReferences(refs); err != nil {
+		return nil, err
+	}
+
+	// Keep the image while other names still refer to it
+	for _, target := range refs {
+		if target == img.ID {
+			return removed, nil
+		}
+	}
+
+	if err := deleteImage(img); err != nil {
+		return removed, err
+	}
+	return append(removed, img.ID), nil
+}
+
+// normalizedName returns the normalized form of ref if it is a name in refs.
+func normalizedName(refs map[string]string, ref string) (string, bool) {
+	parsed, err := ParseReference(ref)
+	if err != nil {
+		return "", false
+	}
+	_, ok := refs[parsed.String()]
+	return parsed.String(), ok
+}
+
+// IsName reports whether ref is one of the names of an image, as opposed
+// to an image ID or ID prefix.
+func IsName(ref string) (bool, error) {
+	refs, err := readReferences()
+	if err != nil {
+		return false, err
+	}
+	_, ok := normalizedName(refs, ref)
+	return ok, nil
+}
+
+// deleteImage deletes an image manifest and the layers no other image uses.
+func deleteImage(img *Image) error {
+	if err := os.Remove(manifestPath(img.ID)); err != nil {
+		return fmt.Errorf("failed to remove image manifest: %w", err)
+	}
+
+	remaining, err := List()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, other := range remaining {
+		for _, layer := range other.Layers {
+			used[layer] = true
+		}
+	}
+
+	for _, layer := range img.Layers {
+		if used[layer] {
+			continue
+		}
+		config.Log.Debugf("Removing layer %s", layer)
+		if err := overlay.Remove(layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listIDs returns the IDs of all images in the store.
+func listIDs() ([]string, error) {
+	entries, err := os.ReadDir(manifestDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	var ids []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			ids = append(ids, digestPrefix+name)
+		}
+	}
+	return ids, nil
+}
+
+// readReferences loads the mapping from image names to image IDs.
+func readReferences() (map[string]string, error) {
+	refs := map[string]string{}
+
+	data, err := os.ReadFile(referencesPath())
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image references: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("failed to decode image references: %w", err)
+	}
+	return refs, nil
+}
+
+// writeReferences stores the mapping from image names to image IDs.
+func writeReferences(refs map[string]string) error {
+	if err := os.MkdirAll(config.ImageDir, 0755); err != nil {
+		return fmt.Errorf("failed to create image directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode image references: %w", err)
+	}
+
+	// Write atomically so a crash never leaves a truncated references file
+	tmp := referencesPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write image references: %w", err)
+	}
+	if err := os.Rename(tmp, referencesPath()); err != nil {
+		return fmt.Errorf("failed to write image references: %w", err)
+	}
+	return nil
+}
+
+func manifestDir() string {
+	return filepath.Join(config.ImageDir, "sha256")
+}
+
+func manifestPath(id string) string {
+	return filepath.Join(manifestDir(), strings.TrimPrefix(id, digestPrefix)+".json")
+}
+
+func referencesPath() string {
+	return filepath.Join(config.ImageDir, "repositories.json")
+}
@@ -0,0 +1,78 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dockerManifest is an entry of the manifest.json file of a `docker save` archive.
+type dockerManifest struct {
+	// Config is the path of the image configuration file
+	Config string `json:"Config"`
+
+	// RepoTags are the names of the image, e.g. "alpine:3.21"
+	RepoTags []string `json:"RepoTags"`
+
+	// Layers are the paths of the uncompressed layer archives, from the base layer up
+	Layers []string `json:"Layers"`
+}
+
+// loadDockerArchive imports the images of an unpacked `docker save`
+// archive. Each image is named after its first repository tag.
+func loadDockerArchive(dir string) ([]Imported, error) {
+	var manifests []dockerManifest
+	if err := readJSON(filepath.Join(dir, "manifest.json"), &manifests); err != nil {
+		return nil, fmt.Errorf("failed to read manifest.json: %w", err)
+	}
+
+	var imported []Imported
+	for _, m := range manifests {
+		configPath, err := archivePath(dir, m.Config)
+		if err != nil {
+			return imported, err
+		}
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return imported, fmt.Errorf("failed to read image configuration: %w", err)
+		}
+		var cfg ImageConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return imported, fmt.Errorf("failed to decode image configuration %s: %w", m.Config, err)
+		}
+
+		layers := make([]Descriptor, len(m.Layers))
+		openers := make([]func() (io.ReadCloser, error), len(m.Layers))
+		for i, layer := range m.Layers {
+			path, err := archivePath(dir, layer)
+			if err != nil {
+				return imported, err
+			}
+			openers[i] = func() (io.ReadCloser, error) {
+				return os.Open(path)
+			}
+		}
+
+		img, err := ImportImage(cfg, layers, openers)
+		if err != nil {
+			return imported, err
+		}
+		i := Imported{Image: img}
+		if len(m.RepoTags) > 0 {
+			i.Name = m.RepoTags[0]
+		}
+		imported = append(imported, i)
+	}
+	return imported, nil
+}
+
+// archivePath returns the path of a file referenced by a `docker save`
+// manifest, which must stay within the archive.
+func archivePath(dir, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid path in manifest.json: %q", name)
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,177 @@
+package oci
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/overlay"
+)
+
+// Exporter converts local images to OCI blobs. Layers are compressed into
+// temporary files once and shared between the images exported with the
+// same exporter.
+type Exporter struct {
+	// dir holds the compressed layer blobs
+	dir string
+
+	// layers caches the exported layers by layer ID
+	layers map[string]ExportedLayer
+}
+
+// ExportedLayer is a layer compressed into a blob.
+type ExportedLayer struct {
+	// Desc describes the compressed blob
+	Desc Descriptor
+
+	// DiffID is the digest of the uncompressed layer archive
+	DiffID string
+
+	// Path is the file holding the blob
+	Path string
+}
+
+// ExportedImage holds the blobs describing an image.
+type ExportedImage struct {
+	// Manifest and ManifestDesc describe the image's manifest blob
+	Manifest     []byte
+	ManifestDesc Descriptor
+
+	// Config and ConfigDesc describe the image's configuration blob
+	Config     []byte
+	ConfigDesc Descriptor
+
+	// Layers are the image's layers, from the base layer up
+	Layers []ExportedLayer
+}
+
+// NewExporter creates an exporter. Close removes its temporary files.
+func NewExporter() (*Exporter, error) {
+	dir, err := os.MkdirTemp("", "containy-export-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return &Exporter{dir: dir, layers: map[string]ExportedLayer{}}, nil
+}
+
+// Close removes the exported layer blobs.
+func (e *Exporter) Close() error {
+	return os.RemoveAll(e.dir)
+}
+
+// Image exports the layers, configuration and manifest of an image.
+func (e *Exporter) Image(img *image.Image) (*ExportedImage, error) {
+	manifest := Manifest{SchemaVersion: 2, MediaType: MediaTypeManifest}
+	cfg := ImageConfig{
+		Created:      &img.Created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Config:       toRuntimeConfig(img.Config),
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{}},
+	}
+
+	exported := &ExportedImage{}
+	for _, id := range img.Layers {
+		layer, err := e.Layer(id)
+		if err != nil {
+			return nil, err
+		}
+		exported.Layers = append(exported.Layers, layer)
+		manifest.Layers = append(manifest.Layers, layer.Desc)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, layer.DiffID)
+	}
+	if manifest.Layers == nil {
+		manifest.Layers = []Descriptor{}
+	}
+	for _, h := range img.History {
+		created := h.Created
+		cfg.History = append(cfg.History, HistoryEntry{Created: &created, CreatedBy: h.CreatedBy, EmptyLayer: h.EmptyLayer})
+	}
+
+	var err error
+	exported.Config, exported.ConfigDesc, err = jsonBlob(MediaTypeConfig, cfg)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Config = exported.ConfigDesc
+
+	exported.Manifest, exported.ManifestDesc, err = jsonBlob(MediaTypeManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	exported.ManifestDesc.Platform = &Platform{Architecture: runtime.GOARCH, OS: "linux"}
+	return exported, nil
+}
+
+// Layer archives and compresses a layer into a blob, computing the digests
+// of the compressed and uncompressed archives on the way.
+func (e *Exporter) Layer(id string) (ExportedLayer, error) {
+	if layer, ok := e.layers[id]; ok {
+		return layer, nil
+	}
+	config.Log.Debugf("Exporting layer %s", id)
+
+	path := filepath.Join(e.dir, id+".tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		return ExportedLayer{}, fmt.Errorf("failed to create layer blob: %w", err)
+	}
+	defer f.Close()
+
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, blobHash)}
+	gz := gzip.NewWriter(counter)
+	if err := archive.WriteLayer(io.MultiWriter(gz, diffHash), overlay.DiffDir(id)); err != nil {
+		return ExportedLayer{}, fmt.Errorf("failed to archive layer %s: %w", id, err)
+	}
+	if err := gz.Close(); err != nil {
+		return ExportedLayer{}, fmt.Errorf("failed to compress layer %s: %w", id, err)
+	}
+	if err := f.Close(); err != nil {
+		return ExportedLayer{}, fmt.Errorf("failed to write layer blob: %w", err)
+	}
+
+	layer := ExportedLayer{
+		Desc: Descriptor{
+			MediaType: MediaTypeLayerGzip,
+			Digest:    "sha256:" + hex.EncodeToString(blobHash.Sum(nil)),
+			Size:      counter.n,
+		},
+		DiffID: "sha256:" + hex.EncodeToString(diffHash.Sum(nil)),
+		Path:   path,
+	}
+	e.layers[id] = layer
+	return layer, nil
+}
+
+// jsonBlob encodes v as a JSON blob and returns it with its descriptor.
+func jsonBlob(mediaType string, v any) ([]byte, Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, Descriptor{}, fmt.Errorf("failed to encode %s: %w", mediaType, err)
+	}
+	sum := sha256.Sum256(data)
+	return data, Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
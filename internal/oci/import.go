@@ -0,0 +1,109 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/archive"
+)
+
+// Import imports the images of a `docker save` archive or an OCI image
+// layout into the local layer and image store. path may be an archive,
+// optionally compressed, or an unpacked directory. The images are
+// not tagged; their names are returned for the caller to apply.
+//
+// Returns:
+//   - []Imported: The imported images with the names they were saved under
+//   - error: Any error encountered while importing the images
+func Import(path string) ([]Imported, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if info.IsDir() {
+		return importDir(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer r.Close()
+
+	dir, err := os.MkdirTemp("", "containy-import-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := archive.Extract(r, dir); err != nil {
+		return nil, fmt.Errorf("failed to unpack %s: %w", path, err)
+	}
+	return importDir(dir)
+}
+
+// IsImageArchive reports whether path is a `docker save` archive or an
+// OCI image layout, as opposed to a plain root filesystem archive.
+func IsImageArchive(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if info.IsDir() {
+		for _, name := range []string{"manifest.json", "oci-layout"} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		switch strings.TrimPrefix(hdr.Name, "./") {
+		case "manifest.json", "oci-layout":
+			return true, nil
+		}
+	}
+}
+
+// importDir imports an unpacked `docker save` archive or OCI image layout.
+// Docker 25 and later write both; the Docker manifest is preferred as it
+// names every image.
+func importDir(dir string) ([]Imported, error) {
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return loadDockerArchive(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err == nil {
+		return loadLayout(dir)
+	}
+	return nil, fmt.Errorf("neither a docker save archive nor an OCI image layout: no manifest.json or oci-layout found")
+}
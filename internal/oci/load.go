@@ -0,0 +1,383 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lariskovski/containy/internal/archive"
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/fsutil"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/overlay"
+)
+
+// Imported is an image imported from an archive or layout.
+type Imported struct {
+	// Image is the image added to the local store
+	Image *image.Image
+
+	// Name is the name the image was saved under, empty if it had none
+	Name string
+}
+
+// Load imports the images of an OCI image layout or `docker save` tar
+// archive into the local layer and image store, and restores their names.
+// The archive may be compressed with any supported format.
+//
+// Returns:
+//   - []Imported: The imported images
+//   - error: Any error encountered while importing the images
+func Load(r io.Reader) ([]Imported, error) {
+	dir, err := os.MkdirTemp("", "containy-load-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dr, err := archive.Decompress(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer dr.Close()
+
+	// The layout needs random access, so the archive is unpacked first
+	if err := archive.Extract(dr, dir); err != nil {
+		return nil, fmt.Errorf("failed to unpack archive: %w", err)
+	}
+	imported, err := importDir(dir)
+	if err != nil {
+		return imported, err
+	}
+
+	for _, i := range imported {
+		if i.Name == "" {
+			continue
+		}
+		if err := image.Tag(i.Name, i.Image.ID); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// loadLayout imports the images of an OCI image layout directory into
+// the local layer and image store.
+func loadLayout(dir string) ([]Imported, error) {
+	var layout Layout
+	if err := readJSON(filepath.Join(dir, "oci-layout"), &layout); err != nil {
+		return nil, fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	if layout.ImageLayoutVersion == "" {
+		return nil, fmt.Errorf("not an OCI image layout: missing imageLayoutVersion")
+	}
+
+	var index Index
+	if err := readJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var imported []Imported
+	for _, desc := range index.Manifests {
+		img, err := loadDescriptor(dir, desc)
+		if err != nil {
+			return imported, err
+		}
+		imported = append(imported, Imported{Image: img, Name: imageName(desc)})
+	}
+	return imported, nil
+}
+
+// loadDescriptor imports the image referenced by a manifest or, for a
+// nested index, the manifest matching the current platform.
+func loadDescriptor(dir string, desc Descriptor) (*image.Image, error) {
+	switch desc.MediaType {
+	case MediaTypeManifest:
+		return loadManifest(dir, desc)
+	case MediaTypeIndex:
+		var index Index
+		if err := readBlobJSON(dir, desc, &index); err != nil {
+			return nil, err
+		}
+		m, err := SelectManifest(index, DefaultPlatform())
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %w", desc.Digest, err)
+		}
+		return loadDescriptor(dir, m)
+	default:
+		return nil, fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+}
+
+// loadManifest imports the layers and configuration of an image manifest.
+func loadManifest(dir string, desc Descriptor) (*image.Image, error) {
+	var manifest Manifest
+	if err := readBlobJSON(dir, desc, &manifest); err != nil {
+		return nil, err
+	}
+	var cfg ImageConfig
+	if err := readBlobJSON(dir, manifest.Config, &cfg); err != nil {
+		return nil, err
+	}
+
+	openers := make([]func() (io.ReadCloser, error), len(manifest.Layers))
+	for i, layerDesc := range manifest.Layers {
+		openers[i] = func() (io.ReadCloser, error) {
+			return openBlob(dir, layerDesc)
+		}
+	}
+	return ImportImage(cfg, manifest.Layers, openers)
+}
+
+// ImportImage imports the layers of an image in order and saves the image
+// to the store. Layers are verified against their descriptor's digest, if
+// any, and against their diff ID while they are unpacked.
+//
+// Parameters:
+//   - cfg: The image configuration, with the diff ID of each layer
+//   - layers: The descriptors of the layer blobs, from the base layer up
+//   - openers: A function opening each layer blob
+//
+// Returns:
+//   - *image.Image: The saved image
+//   - error: Any error encountered while importing the layers
+func ImportImage(cfg ImageConfig, layers []Descriptor, openers []func() (io.ReadCloser, error)) (*image.Image, error) {
+	if len(cfg.RootFS.DiffIDs) != len(layers) {
+		return nil, fmt.Errorf("image has %d layers but %d diff IDs", len(layers), len(cfg.RootFS.DiffIDs))
+	}
+
+	img := &image.Image{Config: toImageConfig(cfg.Config), Created: time.Now().UTC()}
+	if cfg.Created != nil {
+		img.Created = *cfg.Created
+	}
+
+	sizes := make([]int64, len(layers))
+	for i, layerDesc := range layers {
+		id, err := importLayer(img.Layers, layerDesc, cfg.RootFS.DiffIDs[i], openers[i])
+		if err != nil {
+			return nil, err
+		}
+		img.Layers = append(img.Layers, id)
+
+		sizes[i], err = fsutil.DirSize(overlay.DiffDir(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute size of layer %s: %w", id, err)
+		}
+		img.Size += sizes[i]
+	}
+	img.History = importHistory(cfg.History, img.Layers, sizes, img.Created)
+
+	if err := image.Save(img); err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+	return img, nil
+}
+
+// importLayer unpacks a layer blob on top of the given parent layers,
+// unless it was imported before. The layer ID is derived from the parent
+// chain and the diff ID, so identical layer stacks share layers.
+//
+// The blob's digest and the digest of its uncompressed content (the diff
+// ID) are verified while unpacking.
+func importLayer(parents []string, desc Descriptor, diffID string, open func() (io.ReadCloser, error)) (string, error) {
+	parent := ""
+	if len(parents) > 0 {
+		parent = parents[len(parents)-1]
+	}
+	id := chainID(parent, diffID)
+	if _, err := os.Stat(config.BaseOverlayDir + id); err == nil {
+		config.Log.Infof("Layer already exists: %s", id)
+		return id, nil
+	}
+	config.Log.Infof("Importing layer %s", id)
+
+	layer, err := overlay.NewOverlayFS(overlay.LowerDirs(parents), id)
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer %s: %w", id, err)
+	}
+	if err := unpackLayer(desc, diffID, overlay.DiffDir(id), open); err != nil {
+		overlay.Remove(layer.GetID())
+		return "", fmt.Errorf("failed to import layer %s: %w", desc.Digest, err)
+	}
+	return id, nil
+}
+
+// isCompressed reports whether a layer media type denotes a compressed
+// tar archive, e.g. "application/vnd.oci.image.layer.v1.tar+zstd".
+func isCompressed(mediaType string) bool {
+	for _, suffix := range []string{"+gzip", ".gzip", "+zstd"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unpackLayer decompresses and extracts a layer blob into dir.
+func unpackLayer(desc Descriptor, diffID string, dir string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	blobHash := sha256.New()
+	compressed := io.TeeReader(r, blobHash)
+
+	var content io.Reader = compressed
+	switch {
+	case desc.MediaType == "" || isCompressed(desc.MediaType):
+		// Layers of `docker save` archives have no media type, so the
+		// compression is detected from the content, as it is for the
+		// compressed layer types
+		dr, err := archive.Decompress(compressed)
+		if err != nil {
+			return fmt.Errorf("failed to decompress layer: %w", err)
+		}
+		defer dr.Close()
+		content = dr
+	case strings.HasSuffix(desc.MediaType, ".tar"):
+	default:
+		return fmt.Errorf("unsupported layer media type %q", desc.MediaType)
+	}
+
+	diffHash := sha256.New()
+	tee := io.TeeReader(content, diffHash)
+	if err := archive.ApplyLayer(tee, dir); err != nil {
+		return err
+	}
+	// Hash the archive padding the tar reader leaves unread
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, compressed); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	if err := verifyDigest(diffHash, diffID); err != nil {
+		return fmt.Errorf("layer content does not match diff ID: %w", err)
+	}
+	if desc.Digest != "" {
+		if err := verifyDigest(blobHash, desc.Digest); err != nil {
+			return fmt.Errorf("layer blob does not match descriptor: %w", err)
+		}
+	}
+	return nil
+}
+
+// importHistory converts the history of an image configuration, assigning
+// each non-empty entry the next layer. Images without history get one
+// entry per layer. Entries without a time get the image's creation time.
+func importHistory(entries []HistoryEntry, layers []string, sizes []int64, created time.Time) []image.History {
+	var history []image.History
+	next := 0
+	for _, e := range entries {
+		h := image.History{Created: created, CreatedBy: e.CreatedBy, EmptyLayer: e.EmptyLayer}
+		if e.Created != nil {
+			h.Created = *e.Created
+		}
+		if !e.EmptyLayer && next < len(layers) {
+			h.LayerID, h.Size = layers[next], sizes[next]
+			next++
+		}
+		history = append(history, h)
+	}
+	for ; next < len(layers); next++ {
+		history = append(history, image.History{Created: created, CreatedBy: "imported layer", LayerID: layers[next], Size: sizes[next]})
+	}
+	return history
+}
+
+// imageName returns the name an image was saved under, if any. The
+// containerd annotation holds a full reference; the OCI annotation is
+// used when it is one as well rather than only a tag.
+func imageName(desc Descriptor) string {
+	if name := desc.Annotations[AnnotationImageName]; name != "" {
+		return name
+	}
+	if name := desc.Annotations[AnnotationRefName]; strings.ContainsAny(name, ":/") {
+		return name
+	}
+	return ""
+}
+
+// chainID derives a layer ID from the parent layer ID and the diff ID.
+func chainID(parent, diffID string) string {
+	input := diffID
+	if parent != "" {
+		input = parent + " " + diffID
+	}
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])[:config.IDLength]
+}
+
+// openBlob opens a blob of the layout. The digest is verified by the caller.
+func openBlob(dir string, desc Descriptor) (io.ReadCloser, error) {
+	path, err := layoutBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %w", desc.Digest, err)
+	}
+	return f, nil
+}
+
+// readBlobJSON reads and decodes a JSON blob, verifying its digest.
+func readBlobJSON(dir string, desc Descriptor, v any) error {
+	path, err := layoutBlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+	h := sha256.New()
+	h.Write(data)
+	if err := verifyDigest(h, desc.Digest); err != nil {
+		return fmt.Errorf("blob %s is corrupt: %w", desc.Digest, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode blob %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyDigest compares the sum of h with a "sha256:<hex>" digest.
+func verifyDigest(h hash.Hash, digest string) error {
+	actual := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if actual != digest {
+		return fmt.Errorf("expected %s, got %s", digest, actual)
+	}
+	return nil
+}
+
+// layoutBlobPath returns the path of a blob in a layout directory.
+func layoutBlobPath(dir, digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != 64 || strings.Trim(hexDigest, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(dir, blobPath(digest)), nil
+}
+
+// blobPath returns the path of a blob relative to the layout root.
+func blobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
@@ -0,0 +1,171 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lariskovski/containy/internal/image"
+)
+
+// writer writes an OCI image layout as a tar archive. Blobs shared by
+// several images are written once.
+type writer struct {
+	tw *tar.Writer
+
+	// blobs records the digests of the blobs already written
+	blobs map[string]bool
+
+	// exporter produces the blobs of the saved images
+	exporter *Exporter
+
+	// manifests caches the manifest descriptor of each exported image
+	manifests map[string]Descriptor
+}
+
+// Save writes the given images as an OCI image layout tar archive.
+// Images given by name are annotated with it, so that Load restores
+// their names.
+//
+// Parameters:
+//   - w: The writer receiving the archive
+//   - refs: The images to save, by name or ID
+//
+// Returns:
+//   - error: Any error encountered while exporting the images
+func Save(w io.Writer, refs []string) error {
+	exporter, err := NewExporter()
+	if err != nil {
+		return err
+	}
+	defer exporter.Close()
+
+	ow := &writer{
+		tw:        tar.NewWriter(w),
+		blobs:     map[string]bool{},
+		exporter:  exporter,
+		manifests: map[string]Descriptor{},
+	}
+
+	if err := ow.writeJSON("oci-layout", Layout{ImageLayoutVersion: layoutVersion}); err != nil {
+		return err
+	}
+
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeIndex}
+	for _, ref := range refs {
+		img, err := image.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		desc, err := ow.writeImage(img)
+		if err != nil {
+			return fmt.Errorf("failed to save image %s: %w", ref, err)
+		}
+
+		isName, err := image.IsName(ref)
+		if err != nil {
+			return err
+		}
+		if isName {
+			parsed, err := image.ParseReference(ref)
+			if err != nil {
+				return err
+			}
+			desc.Annotations = map[string]string{
+				AnnotationImageName: parsed.String(),
+				AnnotationRefName:   parsed.Tag,
+			}
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	if err := ow.writeJSON("index.json", index); err != nil {
+		return err
+	}
+	return ow.tw.Close()
+}
+
+// writeImage writes the layers, configuration and manifest of an image
+// and returns the manifest's descriptor.
+func (ow *writer) writeImage(img *image.Image) (Descriptor, error) {
+	if desc, ok := ow.manifests[img.ID]; ok {
+		return desc, nil
+	}
+
+	exported, err := ow.exporter.Image(img)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	for _, layer := range exported.Layers {
+		if ow.blobs[layer.Desc.Digest] {
+			continue
+		}
+		f, err := os.Open(layer.Path)
+		if err != nil {
+			return Descriptor{}, fmt.Errorf("failed to open layer blob: %w", err)
+		}
+		err = ow.writeFile(blobPath(layer.Desc.Digest), layer.Desc.Size, f)
+		f.Close()
+		if err != nil {
+			return Descriptor{}, err
+		}
+		ow.blobs[layer.Desc.Digest] = true
+	}
+	if err := ow.writeBlob(exported.ConfigDesc, exported.Config); err != nil {
+		return Descriptor{}, err
+	}
+	if err := ow.writeBlob(exported.ManifestDesc, exported.Manifest); err != nil {
+		return Descriptor{}, err
+	}
+
+	ow.manifests[img.ID] = exported.ManifestDesc
+	return exported.ManifestDesc, nil
+}
+
+// writeBlob writes a blob unless it was written before.
+func (ow *writer) writeBlob(desc Descriptor, data []byte) error {
+	if ow.blobs[desc.Digest] {
+		return nil
+	}
+	if err := ow.writeData(blobPath(desc.Digest), data); err != nil {
+		return err
+	}
+	ow.blobs[desc.Digest] = true
+	return nil
+}
+
+// writeJSON writes v as a JSON file of the layout.
+func (ow *writer) writeJSON(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return ow.writeData(name, data)
+}
+
+func (ow *writer) writeData(name string, data []byte) error {
+	return ow.writeFile(name, int64(len(data)), bytes.NewReader(data))
+}
+
+// writeFile adds a regular file to the archive.
+func (ow *writer) writeFile(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := ow.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := io.Copy(ow.tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
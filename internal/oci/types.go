@@ -0,0 +1,207 @@
+package oci
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lariskovski/containy/internal/image"
+)
+
+// Media types of the OCI image format.
+const (
+	MediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// Docker's equivalents of the OCI index and manifest, served by registries
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Annotations naming the images of a layout.
+const (
+	// AnnotationRefName holds the tag of an image in an OCI layout
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+
+	// AnnotationImageName holds the full reference of an image, as written by containerd
+	AnnotationImageName = "io.containerd.image.name"
+)
+
+// layoutVersion is the version written to the oci-layout file.
+const layoutVersion = "1.0.0"
+
+// Descriptor references a blob by media type, digest and size.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform describes the system an image runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Index lists the manifests of a layout or a multi-platform image.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest describes an image as a configuration and a list of layers.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Layout is the content of the oci-layout file.
+type Layout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ImageConfig is the OCI image configuration.
+type ImageConfig struct {
+	Created      *time.Time     `json:"created,omitempty"`
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       RuntimeConfig  `json:"config"`
+	RootFS       RootFS         `json:"rootfs"`
+	History      []HistoryEntry `json:"history,omitempty"`
+}
+
+// RuntimeConfig holds the defaults for containers created from an image.
+type RuntimeConfig struct {
+	User       string              `json:"User,omitempty"`
+	Env        []string            `json:"Env,omitempty"`
+	WorkingDir string              `json:"WorkingDir,omitempty"`
+	Entrypoint []string            `json:"Entrypoint,omitempty"`
+	Cmd        []string            `json:"Cmd,omitempty"`
+	Volumes    map[string]struct{} `json:"Volumes,omitempty"`
+	Labels     map[string]string   `json:"Labels,omitempty"`
+}
+
+// RootFS lists the digests of the uncompressed layer archives.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// HistoryEntry describes the instruction that produced a step of an image.
+type HistoryEntry struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// DefaultPlatform returns the platform of the running system.
+func DefaultPlatform() Platform {
+	return Platform{Architecture: runtime.GOARCH, OS: "linux"}
+}
+
+// ParsePlatform parses a platform of the form os/arch[/variant], e.g.
+// "linux/arm64". Only Linux platforms are supported.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+	if parts[0] != "linux" {
+		return Platform{}, fmt.Errorf("unsupported platform %q: only linux images can be run", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// String returns the platform in os/arch[/variant] form.
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether a manifest's platform satisfies the wanted one.
+// A variant is only compared when one is wanted; arm64 images without a
+// variant are v8 images.
+func (p Platform) matches(want Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	if want.Variant == "" {
+		return true
+	}
+	variant := p.Variant
+	if variant == "" && p.Architecture == "arm64" {
+		variant = "v8"
+	}
+	return variant == want.Variant
+}
+
+// SelectManifest returns the manifest of an index for the given platform.
+// Manifests without a platform match any platform.
+func SelectManifest(index Index, platform Platform) (Descriptor, error) {
+	for _, m := range index.Manifests {
+		if m.Platform == nil || m.Platform.matches(platform) {
+			return m, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for platform %s", platform)
+}
+
+// toRuntimeConfig converts an image configuration to its OCI form.
+func toRuntimeConfig(c image.Config) RuntimeConfig {
+	rc := RuntimeConfig{
+		User:       c.User,
+		Env:        c.Env,
+		WorkingDir: c.WorkingDir,
+		Entrypoint: c.Entrypoint,
+		Cmd:        c.Cmd,
+		Labels:     c.Labels,
+	}
+	if len(c.Volumes) > 0 {
+		rc.Volumes = map[string]struct{}{}
+		for _, v := range c.Volumes {
+			rc.Volumes[v] = struct{}{}
+		}
+	}
+	return rc
+}
+
+// toImageConfig converts an OCI runtime configuration to an image configuration.
+func toImageConfig(rc RuntimeConfig) image.Config {
+	c := image.Config{
+		Env:        rc.Env,
+		WorkingDir: rc.WorkingDir,
+		User:       rc.User,
+		Entrypoint: rc.Entrypoint,
+		Cmd:        rc.Cmd,
+	}
+	for k, v := range rc.Labels {
+		c.SetLabel(k, v)
+	}
+	volumes := make([]string, 0, len(rc.Volumes))
+	for v := range rc.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	for _, v := range volumes {
+		c.AddVolume(v)
+	}
+	return c
+}
@@ -3,7 +3,7 @@ package overlay
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/lariskovski/containy/internal/config"
 	"golang.org/x/sys/unix"
@@ -106,23 +106,47 @@ func (o *OverlayFS) Mount() error {
 	return nil
 }
 
-func (o *OverlayFS) CreateAlias(alias string) error {
-	// Check if the alias already exists
-	if _, err := os.Stat(filepath.Join(config.AliasDir, alias)); !os.IsNotExist(err) {
-		return fmt.Errorf("alias %s already exists", alias)
+// Unmount detaches the overlay mount from the merged directory.
+func (o *OverlayFS) Unmount() error {
+	config.Log.Debugf("Unmounting overlay filesystem at %s", o.MergedDir)
+	if err := unix.Unmount(o.MergedDir, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount overlay filesystem: %w", err)
 	}
-	// Create the alias directory if it doesn't exist
-	if err := os.MkdirAll(config.AliasDir, 0755); err != nil {
-		return fmt.Errorf("failed to create alias directory: %v", err)
+	return nil
+}
+
+// Remove deletes the layer with the given ID from disk, detaching its
+// merged directory first in case it is still mounted.
+func Remove(id string) error {
+	baseDir := config.BaseOverlayDir + id
+	// The merged directory is usually not mounted, so errors are expected
+	unix.Unmount(baseDir+"/merged", unix.MNT_DETACH)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return fmt.Errorf("failed to remove layer %s: %w", id, err)
 	}
+	return nil
+}
 
-	// Create a symbolic link to the merged directory
-	err := os.Symlink(o.MergedDir, filepath.Join(config.AliasDir, alias))
-	if err != nil {
-		return fmt.Errorf("failed to create alias %s: %v", alias, err)
+// DiffDir returns the directory holding the content of the layer with the
+// given ID: the extracted root filesystem for base layers (which own a
+// lower directory), and the upper directory for all other layers.
+func DiffDir(id string) string {
+	baseDir := config.BaseOverlayDir + id + "/"
+	if info, err := os.Stat(baseDir + "lower"); err == nil && info.IsDir() {
+		return baseDir + "lower"
 	}
+	return baseDir + "upper"
+}
 
-	return nil
+// LowerDirs builds an overlayfs lowerdir option from layer IDs ordered
+// from the bottom (base) layer to the top layer. Overlayfs expects the
+// topmost directory first.
+func LowerDirs(ids []string) string {
+	dirs := make([]string, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		dirs = append(dirs, DiffDir(ids[i]))
+	}
+	return strings.Join(dirs, ":")
 }
 
 // GetID returns the unique identifier for this layer.
@@ -134,6 +158,9 @@ func (o *OverlayFS) GetLowerDir() string { return o.LowerDir }
 // GetUpperDir returns the path to the read-write directory that stores changes.
 func (o *OverlayFS) GetUpperDir() string { return o.UpperDir }
 
+// GetDiffDir returns the path to the directory holding this layer's own content.
+func (o *OverlayFS) GetDiffDir() string { return DiffDir(o.ID) }
+
 // GetWorkDir returns the path to the directory used by overlayfs for internal operations.
 func (o *OverlayFS) GetWorkDir() string { return o.WorkDir }
 
@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+)
+
+// credentials are the username and password for a registry.
+type credentials struct {
+	username string
+	password string
+}
+
+// authFile is the format of the credentials file, shared with Docker's
+// config.json: credentials are stored per registry host, either as a
+// base64 encoded "user:password" or as separate fields.
+type authFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// loadCredentials returns the credentials for a registry host from the
+// credentials file, or nil if there are none.
+func loadCredentials(host string) (*credentials, error) {
+	path := os.Getenv("REGISTRY_AUTH_FILE")
+	if path == "" {
+		path = config.RegistryAuthFile
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	var f authFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode credentials file %s: %w", path, err)
+	}
+
+	for key, entry := range f.Auths {
+		// Docker also stores hosts as URLs, e.g. "https://registry.example.com"
+		if strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"), "/") != host {
+			continue
+		}
+		if entry.Auth == "" {
+			return &credentials{username: entry.Username, password: entry.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials for %s: %w", host, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid credentials for %s: expected user:password", host)
+		}
+		return &credentials{username: username, password: password}, nil
+	}
+	return nil, nil
+}
+
+// challenge is a parsed WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`.
+func parseChallenge(header string) (challenge, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	c := challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	if c.scheme == "" {
+		return c, fmt.Errorf("missing authentication challenge")
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return c, fmt.Errorf("invalid authentication challenge %q", header)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return c, fmt.Errorf("invalid authentication challenge %q", header)
+			}
+			c.params[key] = value[1 : end+1]
+			value = value[end+2:]
+		} else {
+			v, _, _ := strings.Cut(value, ",")
+			c.params[key] = strings.TrimSpace(v)
+			value = value[len(v):]
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), ","))
+	}
+	return c, nil
+}
+
+// fetchToken requests a bearer token from the authorization service named
+// in a challenge, authenticating with the registry credentials if any.
+func (c *Client) fetchToken(ch challenge) (string, error) {
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+
+	q := u.Query()
+	if service := ch.params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", c.scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.creds != nil {
+		req.SetBasicAuth(c.creds.username, c.creds.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("token service returned no token")
+	}
+	return token.Token, nil
+}
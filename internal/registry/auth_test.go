@@ -0,0 +1,194 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lariskovski/containy/internal/oci"
+)
+
+// writeCredentials stores credentials for the fake registry in the
+// credentials file.
+func writeCredentials(t *testing.T, f *fakeRegistry, username, password string) {
+	t.Helper()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	data := fmt.Sprintf(`{"auths": {"http://%s/": {"auth": %q}}}`, f.host(), auth)
+	if err := os.WriteFile(os.Getenv("REGISTRY_AUTH_FILE"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestManifest stores a manifest under the "latest" tag.
+func addTestManifest(t *testing.T, f *fakeRegistry) {
+	t.Helper()
+	data, err := json.Marshal(oci.Manifest{SchemaVersion: 2, MediaType: oci.MediaTypeManifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addManifest(oci.MediaTypeManifest, data, "latest")
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	f := newFakeRegistry(t)
+	addTestManifest(t, f)
+	writeCredentials(t, f, "alice", "secret")
+
+	var tokenRequests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests = append(tokenRequests, r.URL.RawQuery)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "t0ken"}`)
+	})
+	realm := f.server.URL + "/token"
+	f.authorize = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/token" {
+			mux.ServeHTTP(w, r)
+			return false
+		}
+		if r.Header.Get("Authorization") == "Bearer t0ken" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="fake-registry",scope="repository:%s:pull"`, realm, testRepository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	c := f.client("pull")
+	if _, _, err := c.getManifest("latest"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenRequests) != 1 {
+		t.Fatalf("requested %d tokens, want 1", len(tokenRequests))
+	}
+	if want := "scope=repository%3A" + strings.ReplaceAll(testRepository, "/", "%2F") + "%3Apull&service=fake-registry"; tokenRequests[0] != want {
+		t.Errorf("token request query %q, want %q", tokenRequests[0], want)
+	}
+
+	// The token is reused for later requests
+	if _, _, err := c.getManifest("latest"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenRequests) != 1 {
+		t.Errorf("requested %d tokens for two requests, want 1", len(tokenRequests))
+	}
+	if n := f.count("GET", "manifests/latest"); n != 3 {
+		t.Errorf("sent %d manifest requests, want 3 (challenge, retry, reuse)", n)
+	}
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	f := newFakeRegistry(t)
+	addTestManifest(t, f)
+	writeCredentials(t, f, "bob", "hunter2")
+	f.authorize = func(w http.ResponseWriter, r *http.Request) bool {
+		if user, pass, ok := r.BasicAuth(); ok && user == "bob" && pass == "hunter2" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if _, _, err := f.client("pull").getManifest("latest"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("GET", "manifests/latest"); n != 2 {
+		t.Errorf("sent %d manifest requests, want 2 (challenge, retry)", n)
+	}
+}
+
+func TestAuthenticationFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials bool
+		challenge   string
+		want        string
+	}{
+		{"basic without credentials", false, `Basic realm="fake-registry"`, "registry requires credentials"},
+		{"rejected credentials", true, `Basic realm="fake-registry"`, "401 Unauthorized"},
+		{"unsupported scheme", true, `Negotiate`, `unsupported authentication scheme "negotiate"`},
+		{"missing challenge", true, ``, "missing authentication challenge"},
+		{"bearer without realm", true, `Bearer service="fake-registry"`, "bearer challenge without realm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRegistry(t)
+			addTestManifest(t, f)
+			if tt.credentials {
+				writeCredentials(t, f, "bob", "wrong")
+			}
+			f.authorize = func(w http.ResponseWriter, r *http.Request) bool {
+				if tt.challenge != "" {
+					w.Header().Set("WWW-Authenticate", tt.challenge)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return false
+			}
+
+			_, _, err := f.client("pull").getManifest("latest")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %s", err, tt.want)
+			}
+			// A request is retried at most once
+			if n := f.count("GET", "manifests/latest"); n > 2 {
+				t.Errorf("sent %d manifest requests, want at most 2", n)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+		err    bool
+	}{
+		{
+			header: `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/app:pull,push"`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com", "scope": "repository:team/app:pull,push"},
+		},
+		{
+			header: `Basic realm="Registry Realm"`,
+			scheme: "basic",
+			params: map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			header: `bearer Realm=https://auth.example.com/token, service=registry`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"},
+		},
+		{header: `Basic`, scheme: "basic", params: map[string]string{}},
+		{header: ``, err: true},
+		{header: `Bearer realm="unterminated`, err: true},
+		{header: `Bearer realm`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			ch, err := parseChallenge(tt.header)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parsed invalid challenge as %+v", ch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ch.scheme != tt.scheme || !maps.Equal(ch.params, tt.params) {
+				t.Errorf("got %s %v, want %s %v", ch.scheme, ch.params, tt.scheme, tt.params)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+)
+
+// Client talks to the repository of a registry over the OCI distribution API.
+type Client struct {
+	http *http.Client
+
+	// base is the registry's API root, e.g. "https://registry.example.com/v2/"
+	base *url.URL
+
+	// repository is the repository path, e.g. "team/app"
+	repository string
+
+	// scope is the token scope requested for the repository, e.g. "repository:team/app:pull"
+	scope string
+
+	// creds are the credentials for the registry, nil if there are none
+	creds *credentials
+
+	// authorization is the Authorization header value obtained from the last challenge
+	authorization string
+}
+
+// NewClient creates a client for the repository of an image reference.
+// actions are the access rights to request, "pull" or "pull,push".
+//
+// Registries are contacted over HTTPS, except for loopback hosts and the
+// hosts listed in the comma separated CONTAINY_INSECURE_REGISTRIES
+// environment variable, which use plain HTTP.
+func NewClient(ref image.Reference, actions string) (*Client, error) {
+	if ref.Domain == "" {
+		return nil, fmt.Errorf("reference %s does not name a registry host", ref)
+	}
+
+	creds, err := loadCredentials(ref.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "https"
+	if insecure(ref.Domain) {
+		scheme = "http"
+	}
+	return &Client{
+		http:       &http.Client{},
+		base:       &url.URL{Scheme: scheme, Host: ref.Domain, Path: "/v2/"},
+		repository: ref.Path,
+		scope:      fmt.Sprintf("repository:%s:%s", ref.Path, actions),
+		creds:      creds,
+	}, nil
+}
+
+// insecure reports whether a registry host is contacted over plain HTTP.
+func insecure(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, h := range strings.Split(os.Getenv("CONTAINY_INSECURE_REGISTRIES"), ",") {
+		if strings.TrimSpace(h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// url returns the URL of a path in the repository, e.g. "manifests/latest".
+func (c *Client) url(path string) string {
+	return c.base.ResolveReference(&url.URL{Path: c.repository + "/" + path}).String()
+}
+
+// do sends a request, authenticating and retrying once if the registry
+// answers with a challenge. newRequest is called again for the retry, so
+// that request bodies can be replayed.
+func (c *Client) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		header := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(header); err != nil {
+			return nil, fmt.Errorf("failed to authenticate to %s: %w", c.base.Host, err)
+		}
+	}
+}
+
+// authenticate answers an authentication challenge, obtaining a bearer
+// token or using basic authentication with the configured credentials.
+func (c *Client) authenticate(header string) error {
+	ch, err := parseChallenge(header)
+	if err != nil {
+		return err
+	}
+
+	switch ch.scheme {
+	case "bearer":
+		token, err := c.fetchToken(ch)
+		if err != nil {
+			return err
+		}
+		c.authorization = "Bearer " + token
+	case "basic":
+		if c.creds == nil {
+			return fmt.Errorf("registry requires credentials, add them to the credentials file")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.creds.username, c.creds.password)
+		c.authorization = req.Header.Get("Authorization")
+	default:
+		return fmt.Errorf("unsupported authentication scheme %q", ch.scheme)
+	}
+	config.Log.Debugf("Authenticated to %s with %s authentication", c.base.Host, ch.scheme)
+	return nil
+}
+
+// responseError builds an error from an unexpected registry response,
+// including the messages of the registry's error body if any.
+func responseError(resp *http.Response, context string) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		var messages []string
+		for _, e := range body.Errors {
+			messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("%s: %s (%s)", context, resp.Status, strings.Join(messages, "; "))
+	}
+	return fmt.Errorf("%s: %s", context, resp.Status)
+}
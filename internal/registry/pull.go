@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+)
+
+// maxManifestSize bounds the size of manifests and configurations read into memory.
+const maxManifestSize = 4 << 20
+
+// manifestMediaTypes are the manifest formats accepted from registries, in
+// order of preference.
+var manifestMediaTypes = []string{
+	oci.MediaTypeIndex,
+	oci.MediaTypeManifest,
+	oci.MediaTypeDockerManifestList,
+	oci.MediaTypeDockerManifest,
+}
+
+// Pull downloads an image from a registry into the local layer and image
+// store and names it after the reference. For multi-platform images, the
+// manifest for the given platform is pulled.
+//
+// Layers that exist locally are not downloaded again. Every manifest and
+// blob is verified against its digest.
+//
+// Parameters:
+//   - ref: The image reference, including the registry host
+//   - platform: The platform to pull, e.g. linux/arm64
+//
+// Returns:
+//   - *image.Image: The pulled image
+//   - error: Any error encountered while pulling the image
+func Pull(ref image.Reference, platform oci.Platform) (*image.Image, error) {
+	c, err := NewClient(ref, "pull")
+	if err != nil {
+		return nil, err
+	}
+	config.Log.Infof("Pulling %s", ref)
+
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	data, mediaType, err := c.getManifest(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType == oci.MediaTypeIndex || mediaType == oci.MediaTypeDockerManifestList {
+		var index oci.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode index: %w", err)
+		}
+		desc, err := oci.SelectManifest(index, platform)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		config.Log.Debugf("Selected manifest %s for %s", desc.Digest, platform)
+		if data, mediaType, err = c.getManifest(desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if mediaType != oci.MediaTypeManifest && mediaType != oci.MediaTypeDockerManifest {
+		return nil, fmt.Errorf("unsupported manifest media type %q", mediaType)
+	}
+
+	var manifest oci.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	cfgData, err := c.getBlob(manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	var cfg oci.ImageConfig
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode image configuration: %w", err)
+	}
+	if cfg.OS != "" && (cfg.OS != platform.OS || cfg.Architecture != platform.Architecture) {
+		config.Log.Warnf("Image platform %s/%s does not match the requested platform %s", cfg.OS, cfg.Architecture, platform)
+	}
+
+	openers := make([]func() (io.ReadCloser, error), len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		openers[i] = func() (io.ReadCloser, error) {
+			return c.openBlob(desc)
+		}
+	}
+	img, err := oci.ImportImage(cfg, manifest.Layers, openers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images pulled by digest stay unnamed, like loaded images without a name
+	if ref.Tag != "" {
+		ref.Digest = ""
+		if err := image.Tag(ref.String(), img.ID); err != nil {
+			return nil, err
+		}
+	}
+	config.Log.Infof("Pulled %s as image %s", ref, img.ShortID())
+	return img, nil
+}
+
+// getManifest fetches a manifest by tag or digest and verifies its digest.
+//
+// Returns:
+//   - []byte: The manifest
+//   - string: The manifest's media type
+//   - error: Any error encountered while fetching the manifest
+func (c *Client) getManifest(reference string) ([]byte, string, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, c.url("manifests/"+reference), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch manifest %s: %w", reference, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", responseError(resp, "failed to fetch manifest "+reference)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest %s: %w", reference, err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s is too large", reference)
+	}
+
+	// A manifest fetched by digest must match it; otherwise the registry's
+	// digest header, if sent, is checked
+	expected := resp.Header.Get("Docker-Content-Digest")
+	if strings.HasPrefix(reference, "sha256:") {
+		expected = reference
+	}
+	if expected != "" {
+		if err := verify(data, expected); err != nil {
+			return nil, "", fmt.Errorf("manifest %s: %w", reference, err)
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/json" || mediaType == "text/plain" {
+		// Fall back to the media type recorded in the manifest itself
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &probe)
+		mediaType = probe.MediaType
+	}
+	return data, mediaType, nil
+}
+
+// getBlob fetches a small blob, such as an image configuration, and
+// verifies its digest.
+func (c *Client) getBlob(desc oci.Descriptor) ([]byte, error) {
+	body, err := c.openBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("blob %s is too large", desc.Digest)
+	}
+	if err := verify(data, desc.Digest); err != nil {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+	return data, nil
+}
+
+// openBlob starts downloading a blob. The caller verifies its digest.
+func (c *Client) openBlob(desc oci.Descriptor) (io.ReadCloser, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.url("blobs/"+desc.Digest), nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch blob %s: %w", desc.Digest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp, "failed to fetch blob "+desc.Digest)
+	}
+	return resp.Body, nil
+}
+
+// verify checks data against a "sha256:<hex>" digest.
+func verify(data []byte, digest string) error {
+	sum := sha256.Sum256(data)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+	return nil
+}
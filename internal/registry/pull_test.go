@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/oci"
+	"github.com/lariskovski/containy/internal/overlay"
+)
+
+// testImage is an image pushed to the fake registry by addImage.
+type testImage struct {
+	manifest oci.Descriptor
+	config   oci.Descriptor
+	layer    oci.Descriptor
+}
+
+// addImage stores a single layer image for a platform in the fake
+// registry. Its layer holds a file "platform" naming the platform.
+func addImage(t *testing.T, f *fakeRegistry, platform oci.Platform, manifestType string) testImage {
+	t.Helper()
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	content := []byte(platform.String())
+	if err := tw.WriteHeader(&tar.Header{Name: "platform", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+
+	img := testImage{}
+	img.layer = oci.Descriptor{MediaType: oci.MediaTypeLayerGzip, Digest: f.addBlob(gzBuf.Bytes()), Size: int64(gzBuf.Len())}
+
+	cfg, err := json.Marshal(oci.ImageConfig{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		Config:       oci.RuntimeConfig{Cmd: []string{"sh"}},
+		RootFS:       oci.RootFS{Type: "layers", DiffIDs: []string{digestOf(tarBuf.Bytes())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.config = oci.Descriptor{MediaType: oci.MediaTypeConfig, Digest: f.addBlob(cfg), Size: int64(len(cfg))}
+
+	manifest, err := json.Marshal(oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		Config:        img.config,
+		Layers:        []oci.Descriptor{img.layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := platform
+	img.manifest = oci.Descriptor{MediaType: manifestType, Digest: f.addManifest(manifestType, manifest), Size: int64(len(manifest)), Platform: &p}
+	return img
+}
+
+// addIndex stores a multi-platform index of the given images under a tag.
+func addIndex(t *testing.T, f *fakeRegistry, indexType, tag string, images ...testImage) {
+	t.Helper()
+	index := oci.Index{SchemaVersion: 2, MediaType: indexType}
+	for _, img := range images {
+		index.Manifests = append(index.Manifests, img.manifest)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addManifest(indexType, data, tag)
+}
+
+// pulledPlatform returns the content of the "platform" file of a pulled image.
+func pulledPlatform(t *testing.T, layers []string) string {
+	t.Helper()
+	if len(layers) != 1 {
+		t.Fatalf("pulled image has %d layers, want 1", len(layers))
+	}
+	data, err := os.ReadFile(filepath.Join(overlay.DiffDir(layers[0]), "platform"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPullSelectsPlatformFromIndex(t *testing.T) {
+	tests := []struct {
+		name         string
+		indexType    string
+		manifestType string
+		want         oci.Platform
+		pulled       string
+	}{
+		{"oci amd64", oci.MediaTypeIndex, oci.MediaTypeManifest, oci.Platform{OS: "linux", Architecture: "amd64"}, "linux/amd64"},
+		{"oci arm64", oci.MediaTypeIndex, oci.MediaTypeManifest, oci.Platform{OS: "linux", Architecture: "arm64"}, "linux/arm64"},
+		{"oci arm64 v8 without variant", oci.MediaTypeIndex, oci.MediaTypeManifest, oci.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "linux/arm64"},
+		{"oci arm v7", oci.MediaTypeIndex, oci.MediaTypeManifest, oci.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "linux/arm/v7"},
+		{"docker arm64", oci.MediaTypeDockerManifestList, oci.MediaTypeDockerManifest, oci.Platform{OS: "linux", Architecture: "arm64"}, "linux/arm64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdirTemp(t)
+			f := newFakeRegistry(t)
+			addIndex(t, f, tt.indexType, "latest",
+				addImage(t, f, oci.Platform{OS: "linux", Architecture: "amd64"}, tt.manifestType),
+				addImage(t, f, oci.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, tt.manifestType),
+				addImage(t, f, oci.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, tt.manifestType),
+				addImage(t, f, oci.Platform{OS: "linux", Architecture: "arm64"}, tt.manifestType),
+			)
+
+			img, err := Pull(f.reference(":latest"), tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pulledPlatform(t, img.Layers); got != tt.pulled {
+				t.Errorf("pulled %s, want %s", got, tt.pulled)
+			}
+			for _, mediaType := range manifestMediaTypes {
+				if !strings.Contains(f.accept, mediaType) {
+					t.Errorf("Accept header %q does not include %s", f.accept, mediaType)
+				}
+			}
+		})
+	}
+}
+
+func TestPullNoMatchingPlatform(t *testing.T) {
+	chdirTemp(t)
+	f := newFakeRegistry(t)
+	addIndex(t, f, oci.MediaTypeIndex, "latest",
+		addImage(t, f, oci.Platform{OS: "linux", Architecture: "amd64"}, oci.MediaTypeManifest),
+		addImage(t, f, oci.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, oci.MediaTypeManifest),
+	)
+
+	_, err := Pull(f.reference(":latest"), oci.Platform{OS: "linux", Architecture: "arm64", Variant: "v9"})
+	if err == nil || !strings.Contains(err.Error(), "no manifest for platform") {
+		t.Fatalf("got error %v, want no manifest for platform", err)
+	}
+}
+
+func TestPullSingleManifestByDigest(t *testing.T) {
+	chdirTemp(t)
+	f := newFakeRegistry(t)
+	img := addImage(t, f, oci.Platform{OS: "linux", Architecture: "amd64"}, oci.MediaTypeManifest)
+
+	pulled, err := Pull(f.reference("@"+img.manifest.Digest), oci.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pulledPlatform(t, pulled.Layers); got != "linux/amd64" {
+		t.Errorf("pulled %s, want linux/amd64", got)
+	}
+}
+
+func TestPullRejectsDigestMismatch(t *testing.T) {
+	amd64 := oci.Platform{OS: "linux", Architecture: "amd64"}
+	tests := []struct {
+		name   string
+		tamper func(f *fakeRegistry, img testImage)
+		ref    func(img testImage) string
+		want   string
+	}{
+		{
+			name:   "manifest digest header",
+			tamper: func(f *fakeRegistry, img testImage) { f.digestHeader = digestOf([]byte("other")) },
+			ref:    func(testImage) string { return ":latest" },
+			want:   "manifest latest: digest mismatch",
+		},
+		{
+			name: "manifest fetched by digest",
+			tamper: func(f *fakeRegistry, img testImage) {
+				m := f.manifests[img.manifest.Digest]
+				m.data = append(m.data, ' ')
+				f.manifests[img.manifest.Digest] = m
+				f.digestHeader = img.manifest.Digest
+			},
+			ref:  func(img testImage) string { return "@" + img.manifest.Digest },
+			want: "digest mismatch",
+		},
+		{
+			name:   "config blob",
+			tamper: func(f *fakeRegistry, img testImage) { f.blobs[img.config.Digest] = []byte(`{"os":"linux"}`) },
+			ref:    func(testImage) string { return ":latest" },
+			want:   "digest mismatch",
+		},
+		{
+			// The same content compressed differently matches the diff ID
+			// but not the blob digest
+			name: "layer blob",
+			tamper: func(f *fakeRegistry, img testImage) {
+				gr, err := gzip.NewReader(bytes.NewReader(f.blobs[img.layer.Digest]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				gw, _ := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+				if _, err := io.Copy(gw, gr); err != nil {
+					t.Fatal(err)
+				}
+				gw.Close()
+				f.blobs[img.layer.Digest] = buf.Bytes()
+			},
+			ref:  func(testImage) string { return ":latest" },
+			want: "layer blob does not match descriptor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdirTemp(t)
+			f := newFakeRegistry(t)
+			img := addImage(t, f, amd64, oci.MediaTypeManifest)
+			f.manifests["latest"] = f.manifests[img.manifest.Digest]
+			tt.tamper(f, img)
+
+			_, err := Pull(f.reference(tt.ref(img)), amd64)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %s", err, tt.want)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(config.ImageDir, "sha256")); len(entries) > 0 {
+				t.Errorf("image %s was stored despite the mismatch", entries[0].Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/lariskovski/containy/internal/config"
+	"github.com/lariskovski/containy/internal/image"
+	"github.com/lariskovski/containy/internal/oci"
+)
+
+// DefaultChunkSize is the size of the chunks large blobs are uploaded in.
+const DefaultChunkSize = 16 << 20
+
+// Push uploads a local image to a registry under the reference's tag.
+// Blobs that already exist in the repository are skipped. Blobs larger
+// than chunkSize are uploaded in chunks, smaller ones in a single request.
+//
+// Parameters:
+//   - ref: The destination reference, including the registry host and a tag
+//   - img: The image to push
+//   - chunkSize: The maximum size of an upload request body, 0 for monolithic uploads
+//
+// Returns:
+//   - string: The digest of the pushed manifest
+//   - error: Any error encountered while pushing the image
+func Push(ref image.Reference, img *image.Image, chunkSize int64) (string, error) {
+	if ref.Digest != "" {
+		return "", fmt.Errorf("cannot push to digest reference %s, use a tag", ref)
+	}
+	c, err := NewClient(ref, "pull,push")
+	if err != nil {
+		return "", err
+	}
+	config.Log.Infof("Pushing image %s to %s", img.ShortID(), ref)
+
+	exporter, err := oci.NewExporter()
+	if err != nil {
+		return "", err
+	}
+	defer exporter.Close()
+	exported, err := exporter.Image(img)
+	if err != nil {
+		return "", err
+	}
+
+	for _, layer := range exported.Layers {
+		f, err := os.Open(layer.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to open layer blob: %w", err)
+		}
+		err = c.pushBlob(layer.Desc, f, chunkSize)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := c.pushBlob(exported.ConfigDesc, bytes.NewReader(exported.Config), chunkSize); err != nil {
+		return "", err
+	}
+
+	if err := c.putManifest(ref.Tag, exported.ManifestDesc, exported.Manifest); err != nil {
+		return "", err
+	}
+	config.Log.Infof("Pushed %s with digest %s", ref, exported.ManifestDesc.Digest)
+	return exported.ManifestDesc.Digest, nil
+}
+
+// pushBlob uploads a blob unless the repository already has it.
+func (c *Client) pushBlob(desc oci.Descriptor, r io.ReaderAt, chunkSize int64) error {
+	exists, err := c.blobExists(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		config.Log.Infof("Blob %s already exists", desc.Digest)
+		return nil
+	}
+	config.Log.Infof("Uploading blob %s (%d bytes)", desc.Digest, desc.Size)
+
+	location, minChunk, err := c.startUpload()
+	if err != nil {
+		return err
+	}
+	if chunkSize > 0 && chunkSize < minChunk {
+		chunkSize = minChunk
+	}
+
+	var offset int64
+	if chunkSize > 0 && desc.Size > chunkSize {
+		// Send all but the final chunk with PATCH; the last one goes with
+		// the closing PUT
+		for desc.Size-offset > chunkSize {
+			if location, err = c.patchChunk(location, io.NewSectionReader(r, offset, chunkSize), offset, chunkSize); err != nil {
+				return fmt.Errorf("failed to upload blob %s: %w", desc.Digest, err)
+			}
+			offset += chunkSize
+		}
+	}
+	return c.finishUpload(location, desc.Digest, io.NewSectionReader(r, offset, desc.Size-offset), desc.Size-offset)
+}
+
+// blobExists reports whether the repository has a blob.
+func (c *Client) blobExists(digest string) (bool, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, c.url("blobs/"+digest), nil)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check blob %s: %w", digest, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(resp, "failed to check blob "+digest)
+	}
+}
+
+// startUpload opens an upload session.
+//
+// Returns:
+//   - *url.URL: The location to send the blob's content to
+//   - int64: The minimum chunk size required by the registry, 0 if any
+//   - error: Any error encountered while opening the session
+func (c *Client) startUpload() (*url.URL, int64, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, c.url("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to start upload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, 0, responseError(resp, "failed to start upload")
+	}
+
+	location, err := c.location(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	minChunk, _ := strconv.ParseInt(resp.Header.Get("OCI-Chunk-Min-Length"), 10, 64)
+	return location, minChunk, nil
+}
+
+// patchChunk uploads a chunk of a blob starting at offset and returns the
+// location for the next request.
+func (c *Client) patchChunk(location *url.URL, chunk io.ReadSeeker, offset, size int64) (*url.URL, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPatch, location.String(), io.NopCloser(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+size-1))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, responseError(resp, "chunk upload rejected")
+	}
+	return c.location(resp)
+}
+
+// finishUpload sends the remaining content of a blob and closes the
+// upload session, the registry verifying the blob against its digest.
+func (c *Client) finishUpload(location *url.URL, digest string, rest io.ReadSeeker, size int64) error {
+	u := *location
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(func() (*http.Request, error) {
+		if _, err := rest.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, u.String(), io.NopCloser(rest))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", digest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, "failed to upload blob "+digest)
+	}
+	return nil
+}
+
+// putManifest uploads an image manifest under a tag and checks the digest
+// computed by the registry.
+func (c *Client) putManifest(tag string, desc oci.Descriptor, data []byte) error {
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, c.url("manifests/"+tag), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", desc.MediaType)
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, "failed to upload manifest")
+	}
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != desc.Digest {
+		return fmt.Errorf("registry stored manifest with digest %s, expected %s", digest, desc.Digest)
+	}
+	return nil
+}
+
+// location returns the upload location of a response, resolved against
+// the registry's URL.
+func (c *Client) location(resp *http.Response) (*url.URL, error) {
+	header := resp.Header.Get("Location")
+	if header == "" {
+		return nil, fmt.Errorf("registry did not return an upload location")
+	}
+	u, err := c.base.Parse(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location %q: %w", header, err)
+	}
+	return u, nil
+}
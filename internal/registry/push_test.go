@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/lariskovski/containy/internal/oci"
+)
+
+// blobOf returns a blob of the given size and its descriptor.
+func blobOf(size int) ([]byte, oci.Descriptor) {
+	data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+	return data, oci.Descriptor{MediaType: oci.MediaTypeLayerGzip, Digest: digestOf(data), Size: int64(size)}
+}
+
+func TestPushBlobUploads(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int64
+		minChunk  int64
+		patches   []int
+		put       int
+	}{
+		{name: "monolithic", size: 100, chunkSize: 0, put: 100},
+		{name: "smaller than a chunk", size: 100, chunkSize: 100, put: 100},
+		{name: "chunked", size: 25, chunkSize: 10, patches: []int{10, 10}, put: 5},
+		{name: "chunked exact multiple", size: 30, chunkSize: 10, patches: []int{10, 10}, put: 10},
+		{name: "registry minimum chunk size", size: 45, chunkSize: 10, minChunk: 20, patches: []int{20, 20}, put: 5},
+		{name: "minimum below chunk size", size: 45, chunkSize: 20, minChunk: 5, patches: []int{20, 20}, put: 5},
+		{name: "minimum ignored for monolithic", size: 45, chunkSize: 0, minChunk: 20, put: 45},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRegistry(t)
+			f.minChunk = tt.minChunk
+			data, desc := blobOf(tt.size)
+
+			if err := f.client("pull,push").pushBlob(desc, bytes.NewReader(data), tt.chunkSize); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(f.blobs[desc.Digest], data) {
+				t.Fatal("registry did not store the blob")
+			}
+			if !slices.Equal(f.patches, tt.patches) {
+				t.Errorf("PATCH sizes %v, want %v", f.patches, tt.patches)
+			}
+			if !slices.Equal(f.puts, []int{tt.put}) {
+				t.Errorf("PUT sizes %v, want [%d]", f.puts, tt.put)
+			}
+		})
+	}
+}
+
+func TestPushBlobSkipsExisting(t *testing.T) {
+	f := newFakeRegistry(t)
+	data, desc := blobOf(100)
+	f.addBlob(data)
+
+	if err := f.client("pull,push").pushBlob(desc, bytes.NewReader(data), 10); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("HEAD", "blobs/"+desc.Digest); n != 1 {
+		t.Errorf("sent %d HEAD requests for the blob, want 1", n)
+	}
+	if n := f.count("POST", "blobs/uploads/"); n != 0 {
+		t.Errorf("started %d uploads of an existing blob", n)
+	}
+	if len(f.patches) > 0 || len(f.puts) > 0 {
+		t.Errorf("uploaded an existing blob: PATCH %v, PUT %v", f.patches, f.puts)
+	}
+}
+
+func TestPushBlobRejectedDigest(t *testing.T) {
+	f := newFakeRegistry(t)
+	data, desc := blobOf(100)
+	desc.Digest = digestOf([]byte("other"))
+
+	err := f.client("pull,push").pushBlob(desc, bytes.NewReader(data), 0)
+	if err == nil {
+		t.Fatal("upload of a blob not matching its digest succeeded")
+	}
+	if _, ok := f.blobs[desc.Digest]; ok {
+		t.Error("registry stored the blob")
+	}
+}
+
+func TestPutManifestChecksDigest(t *testing.T) {
+	f := newFakeRegistry(t)
+	data, err := json.Marshal(oci.Manifest{SchemaVersion: 2, MediaType: oci.MediaTypeManifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := oci.Descriptor{MediaType: oci.MediaTypeManifest, Digest: digestOf(data), Size: int64(len(data))}
+	c := f.client("pull,push")
+
+	if err := c.putManifest("v1", desc, data); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.manifests["v1"]; got.mediaType != oci.MediaTypeManifest || !bytes.Equal(got.data, data) {
+		t.Errorf("registry stored %s %q", got.mediaType, got.data)
+	}
+
+	desc.Digest = digestOf([]byte("other"))
+	if err := c.putManifest("v2", desc, data); err == nil {
+		t.Error("putManifest accepted a digest not matching the registry's")
+	}
+}
@@ -0,0 +1,275 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lariskovski/containy/internal/image"
+)
+
+// testRepository is the repository the fake registry serves.
+const testRepository = "test/app"
+
+// storedManifest is a manifest held by the fake registry.
+type storedManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is an in-process stand-in for a registry implementing the
+// parts of the OCI distribution API used by the client.
+type fakeRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]storedManifest
+	uploads   map[string]*bytes.Buffer
+
+	// minChunk is sent as OCI-Chunk-Min-Length when an upload starts
+	minChunk int64
+
+	// digestHeader overrides the Docker-Content-Digest header of manifests
+	digestHeader string
+
+	// authorize decides whether a request is let through; it writes the
+	// challenge and returns false otherwise
+	authorize func(w http.ResponseWriter, r *http.Request) bool
+
+	// requests are the requests received, as "METHOD path"
+	requests []string
+
+	// patches are the sizes of the PATCH request bodies, puts those of
+	// the PUT requests closing uploads
+	patches []int
+	puts    []int
+
+	// accept is the Accept header of the last manifest request
+	accept string
+}
+
+// newFakeRegistry starts a fake registry and points the credentials file
+// at an empty location.
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+	t.Setenv("REGISTRY_AUTH_FILE", filepath.Join(t.TempDir(), "auth.json"))
+
+	f := &fakeRegistry{
+		t:         t,
+		blobs:     map[string][]byte{},
+		manifests: map[string]storedManifest{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// host returns the registry's host:port.
+func (f *fakeRegistry) host() string {
+	return strings.TrimPrefix(f.server.URL, "http://")
+}
+
+// reference parses a reference to the fake registry's repository, e.g.
+// ":latest" or "@sha256:<hex>".
+func (f *fakeRegistry) reference(suffix string) image.Reference {
+	f.t.Helper()
+	ref, err := image.ParseReference(f.host() + "/" + testRepository + suffix)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return ref
+}
+
+// client creates a client for the fake registry's repository.
+func (f *fakeRegistry) client(actions string) *Client {
+	f.t.Helper()
+	c, err := NewClient(f.reference(":latest"), actions)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return c
+}
+
+// addBlob stores a blob and returns its digest.
+func (f *fakeRegistry) addBlob(data []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := digestOf(data)
+	f.blobs[d] = data
+	return d
+}
+
+// addManifest stores a manifest under its digest and the given tags and
+// returns its digest.
+func (f *fakeRegistry) addManifest(mediaType string, data []byte, tags ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := digestOf(data)
+	m := storedManifest{mediaType: mediaType, data: data}
+	f.manifests[d] = m
+	for _, tag := range tags {
+		f.manifests[tag] = m
+	}
+	return d
+}
+
+// count returns the number of received requests with the given method and
+// path prefix, relative to the repository.
+func (f *fakeRegistry) count(method, prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" /v2/"+testRepository+"/"+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	authorize := f.authorize
+	f.mu.Unlock()
+
+	if authorize != nil && !authorize(w, r) {
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/v2/"+testRepository+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(path, "manifests/"):
+		f.serveManifest(w, r, strings.TrimPrefix(path, "manifests/"))
+	case path == "blobs/uploads/" && r.Method == http.MethodPost:
+		id := strconv.Itoa(len(f.uploads))
+		f.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+testRepository+"/blobs/uploads/"+id)
+		if f.minChunk > 0 {
+			w.Header().Set("OCI-Chunk-Min-Length", strconv.FormatInt(f.minChunk, 10))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(path, "blobs/uploads/"):
+		f.serveUpload(w, r, strings.TrimPrefix(path, "blobs/uploads/"))
+	case strings.HasPrefix(path, "blobs/"):
+		data, ok := f.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, reference string) {
+	switch r.Method {
+	case http.MethodGet:
+		f.accept = r.Header.Get("Accept")
+		m, ok := f.manifests[reference]
+		if !ok || !strings.Contains(f.accept, m.mediaType) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		digest := digestOf(m.data)
+		if f.digestHeader != "" {
+			digest = f.digestHeader
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(m.data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		m := storedManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+		f.manifests[reference] = m
+		f.manifests[digestOf(data)] = m
+		w.Header().Set("Docker-Content-Digest", digestOf(data))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, id string) {
+	upload, ok := f.uploads[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodPatch:
+		if want := fmt.Sprintf("%d-%d", upload.Len(), upload.Len()+len(data)-1); r.Header.Get("Content-Range") != want {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if f.minChunk > 0 && int64(len(data)) < f.minChunk {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.patches = append(f.patches, len(data))
+		upload.Write(data)
+		w.Header().Set("Location", "/v2/"+testRepository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		f.puts = append(f.puts, len(data))
+		upload.Write(data)
+		digest := r.URL.Query().Get("digest")
+		if digestOf(upload.Bytes()) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest mismatch"}]}`)
+			return
+		}
+		f.blobs[digest] = upload.Bytes()
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// digestOf returns the "sha256:<hex>" digest of data.
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// chdirTemp runs the rest of the test in an empty working directory, where
+// layers and images are stored.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
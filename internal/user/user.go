@@ -0,0 +1,204 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lariskovski/containy/internal/archive"
+)
+
+// User is a user resolved against a container filesystem's
+// /etc/passwd and /etc/group.
+type User struct {
+	// Name is the user name, empty for numeric users not found in /etc/passwd
+	Name string
+
+	// Uid and Gid are the numeric user and primary group IDs
+	Uid uint32
+	Gid uint32
+
+	// Groups are the supplementary group IDs
+	Groups []uint32
+
+	// Home is the user's home directory
+	Home string
+}
+
+// passwdEntry is a line of /etc/passwd.
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+// groupEntry is a line of /etc/group.
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// Lookup resolves a user specification of the form user[:group], where
+// both parts are either names or numeric IDs, against the passwd and
+// group files of the filesystem rooted at root.
+//
+// Numeric IDs do not need to exist in the files. When only a user is
+// given, the primary group comes from /etc/passwd, and a named user also
+// gets the supplementary groups listing it as a member.
+func Lookup(root, spec string) (*User, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" || (hasGroup && groupPart == "") {
+		return nil, fmt.Errorf("invalid user %q: expected user[:group]", spec)
+	}
+
+	// The files are resolved within root, so that an image's absolute
+	// symbolic link, e.g. /etc/passwd -> /etc/passwd.real, does not lead
+	// to the host's files
+	passwdPath, err := archive.SecureJoin(root, "etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve /etc/passwd: %w", err)
+	}
+	groupPath, err := archive.SecureJoin(root, "etc/group")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve /etc/group: %w", err)
+	}
+
+	passwd, err := readPasswd(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readGroup(groupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{Home: "/"}
+	if uid, err := parseID(userPart); err == nil {
+		u.Uid = uid
+		for _, p := range passwd {
+			if p.uid == uid {
+				u.Name, u.Gid, u.Home = p.name, p.gid, p.home
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, p := range passwd {
+			if p.name == userPart {
+				u.Name, u.Uid, u.Gid, u.Home = p.name, p.uid, p.gid, p.home
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+	}
+
+	if hasGroup {
+		gid, err := lookupGroup(groups, groupPart)
+		if err != nil {
+			return nil, err
+		}
+		u.Gid = gid
+		return u, nil
+	}
+
+	if u.Name != "" {
+		for _, g := range groups {
+			if g.gid == u.Gid {
+				continue
+			}
+			for _, m := range g.members {
+				if m == u.Name {
+					u.Groups = append(u.Groups, g.gid)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// lookupGroup resolves a group name or numeric ID.
+func lookupGroup(groups []groupEntry, spec string) (uint32, error) {
+	if gid, err := parseID(spec); err == nil {
+		return gid, nil
+	}
+	for _, g := range groups {
+		if g.name == spec {
+			return g.gid, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", spec)
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// readPasswd parses an /etc/passwd file. A missing file is treated as empty.
+func readPasswd(path string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 7 {
+			return
+		}
+		uid, err1 := parseID(fields[2])
+		gid, err2 := parseID(fields[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	})
+	return entries, err
+}
+
+// readGroup parses an /etc/group file. A missing file is treated as empty.
+func readGroup(path string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 4 {
+			return
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	})
+	return entries, err
+}
+
+func readColonFile(path string, fn func([]string)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}